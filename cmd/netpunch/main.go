@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,10 +14,12 @@ import (
 	"os/signal"
 	"path"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/michurin/netpunch/netpunchlib"
 )
@@ -31,7 +34,11 @@ var (
 	// CLI flags.
 	role        string
 	secret      string
-	remoteAddr  string
+	secretFile  string
+	keysFile    string
+	keyring     *netpunchlib.Keyring // nil if keys file is not specified
+	remoteAddr  listFlag
+	siblings    listFlag
 	localAddr   string
 	showVersion bool
 	silentMode  bool
@@ -39,6 +46,43 @@ var (
 	templateObj *template.Template // won't be nil after setupFlags()
 	command     string
 	commandArgs []cliArgument
+	schedule    []netpunchlib.Option
+	maxCycles   int
+	timeout     time.Duration
+	network     string
+	localCands  bool
+	keepalive   time.Duration
+	kaTimeout   time.Duration
+	handoff     string
+	relayAfter  int
+	relayPorts  string
+	relayIdle   time.Duration
+	groupSize   int
+	slotTTL     time.Duration
+	consumeOnce bool
+	stateFile   string
+	registry    string
+	rateLimit   float64
+	rateBurst   int
+	rateTotal   float64
+	probe       bool
+	probeLocal  string
+	predictWin  int
+	predictVia  string
+	replayWin   time.Duration
+	encrypt     bool
+	credsFile   string
+	ctrlSecret  string
+	genKey      string
+	privateKey  ed25519.PrivateKey // nil if -key-file is not specified
+	trustedKeys []ed25519.PublicKey
+
+	// Files of CLI flags; they are read right after parsing.
+	ctrlSecretFile string
+	keyFile        string
+	trustedFile    string
+	templateFile   string
+	templateText   string // it is not file, however it is alternative to templateFile
 )
 
 type cliArgument struct {
@@ -57,22 +101,269 @@ func setupVersion() {
 }
 
 func setupFlags() error {
-	var err error
-	var secretFile, templateFile, templateText string
-
 	flag.CommandLine.SetOutput(os.Stderr)
+	setupCommonFlags()
+	setupCryptoFlags()
+	setupControlFlags()
+	setupClientFlags()
+	setupRelayFlags()
+	setupCommandFlags()
+	setupUsage()
+
+	flag.Parse()
+
+	err := readCryptoFiles()
+	if err != nil {
+		return err
+	}
+	return readTemplate()
+}
+
+func setupCommonFlags() {
 	flag.BoolVar(&showVersion, "version", false, "print version and exit")
 	flag.BoolVar(&silentMode, "silent", false, "silent mode")
 	flag.BoolVar(&rawMode, "raw-logging", false, "log raw messages, including cryptography signatures")
-	flag.StringVar(&role, "peer", "", `role of peer: a-z
-it is linking a and b, c and d and so on up to y and z
+	flag.StringVar(&role, "peer", "", `name of peer: session:side, like office-vpn:left
+it is linking peers with the same session name, like office-vpn:left and office-vpn:right
+legacy names a-z are still supported: they link a and b, c and d and so on up to y and z
 if peer not specified, we run in control mode`)
-	flag.StringVar(&secret, "secret", "", "shared secret to sign messages")
-	flag.StringVar(&secretFile, "secret-file", "", "get shared secret from file")
-	flag.StringVar(&remoteAddr, "remote", "", "public address of control node; for peer-mode only")
 	flag.StringVar(&localAddr, "local", "", `local address
 in control mode it is listening address
 in peer mode it is outgoing address`)
+	flag.StringVar(&network, "network", "udp", `network: udp4 (IPv4 only), udp6 (IPv6 only) or udp (dual-stack)
+in dual-stack mode peer announces itself over IPv4 and IPv6 and prefers IPv6 when punching`)
+}
+
+func checkCommonFlags() error {
+	if localAddr == "" {
+		return errors.New("you have to specify local address")
+	}
+	if probe && role != "" {
+		return errors.New("you do not have to specify peer in probe mode")
+	}
+	return nil
+}
+
+func setupCryptoFlags() {
+	flag.StringVar(&secret, "secret", "", "shared secret to sign messages")
+	flag.StringVar(&secretFile, "secret-file", "", "get shared secret from file")
+	flag.StringVar(&keysFile, "keys-file", "", `get list of keys from file instead of shared secret: lines like "id secret",
+the first key signs messages, all keys verify them; list is re-read on SIGHUP`)
+	flag.StringVar(&genKey, "genkey", "", "generate Ed25519 key pair: write private key to PATH and public key to PATH.pub, and exit")
+	flag.StringVar(&keyFile, "key-file", "", `sign messages by Ed25519 private key (see -genkey) instead of shared secret;
+-secret is not required; see -trusted-keys`)
+	flag.StringVar(&trustedFile, "trusted-keys", "", `file of trusted public keys, one per line; messages signed by them are accepted;
+peer trusts control node and opposite peer, control node trusts peers; see -key-file
+control node can bind public keys to identities using -credentials file instead`)
+	flag.StringVar(&ctrlSecret, "control-secret", "", `individual secret to sign messages to control node (see -credentials);
+-secret signs messages to peer then; for peer-mode and probe mode;
+in control mode it signs messages to siblings (see -sibling), it is required with -sibling`)
+	flag.StringVar(&ctrlSecretFile, "control-secret-file", "", "get individual secret from file; see -control-secret")
+	flag.BoolVar(&encrypt, "encrypt", false, `encrypt messages by key derived from secret instead of signing them;
+it hides peers' addresses from anyone watching the path; all peers and control node have to use it`)
+	flag.DurationVar(&replayWin, "replay-window", 0, `reject signed messages older (or newer) than this, and replayed ones, like 30s;
+clocks of peers and control node have to be synchronized; all peers and control node have to use it; 0 (default) disables it`)
+}
+
+// readCryptoFiles reads secrets and keys from files specified by crypto flags.
+func readCryptoFiles() error {
+	var err error
+	secret, err = readFile(secretFile, secret)
+	if err != nil {
+		return err
+	}
+	if keysFile != "" {
+		keys, err := readKeys()
+		if err != nil {
+			return fmt.Errorf("%s: %w", keysFile, err)
+		}
+		keyring, err = netpunchlib.NewKeyring(keys...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", keysFile, err)
+		}
+	}
+	ctrlSecret, err = readFile(ctrlSecretFile, ctrlSecret)
+	if err != nil {
+		return err
+	}
+	if keyFile != "" {
+		key, err := readFile(keyFile, "")
+		if err != nil {
+			return err
+		}
+		privateKey, err = netpunchlib.ParsePrivateKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	if trustedFile != "" {
+		f, err := os.Open(trustedFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		trustedKeys, err = netpunchlib.ParsePublicKeys(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", trustedFile, err)
+		}
+	}
+	return nil
+}
+
+func checkCryptoFlags() error {
+	if secret == "" && privateKey == nil && keyring == nil && (!controlMode() || credsFile == "") {
+		return errors.New("you have to specify secret")
+	}
+	if privateKey != nil && (trustedKeys == nil) == (credsFile == "") {
+		return errors.New("you have to specify either trusted keys or credentials to use private key")
+	}
+	if privateKey != nil && (encrypt || ctrlSecret != "") {
+		return errors.New("private key can not be used with encryption and control secret")
+	}
+	if keyring != nil && (secret != "" || encrypt || privateKey != nil || credsFile != "") {
+		return errors.New("list of keys can not be used with secret, encryption, private key and credentials")
+	}
+	if ctrlSecret != "" && controlMode() && len(siblings) == 0 {
+		return errors.New("control secret is for peer and probe modes and for clusters only")
+	}
+	if replayWin < 0 {
+		return errors.New("limits and intervals can not be negative")
+	}
+	return nil
+}
+
+func setupControlFlags() {
+	flag.StringVar(&credsFile, "credentials", "", `file of individual secrets: lines like "identity secret", where identity is
+session name or peer name; control node accepts announces signed by secret of corresponding identity only;
+-secret is not required; for control mode only`)
+	flag.DurationVar(&slotTTL, "slot-ttl", time.Minute, `forget peer after this time since its last announce;
+it has to be longer than sleeping phase of peers (see -backoff); for control mode only`)
+	flag.BoolVar(&consumeOnce, "consume-once", false, `forget peers as soon as they confirm pairing, so they are never reported
+to restarted opposite peers; for control mode only`)
+	flag.Var(&siblings, "sibling", `address of sibling control node to replicate registrations to and from;
+it can be repeated or comma-separated; every control node of cluster has to list all others; requires -control-secret; for control mode only`)
+	flag.StringVar(&stateFile, "state-file", "", `keep registered peers in this file, so they survive restart of control node;
+it is saved every second and on shutdown; for control mode only`)
+	flag.StringVar(&registry, "registry", "memory", `registry of peers: `+strings.Join(registryNames(), ", ")+`; for control mode only`)
+	flag.Float64Var(&rateLimit, "rate-limit", 0, `drop packets from source IP over this number per second, like 20; 0 (default) means no limit;
+for control mode only, siblings are not limited; see -rate-burst and -rate-limit-total`)
+	flag.IntVar(&rateBurst, "rate-burst", 40, "allow bursts of this number of packets from source IP; see -rate-limit")
+	flag.Float64Var(&rateTotal, "rate-limit-total", 0, "drop packets over this total number per second; 0 means no limit; see -rate-limit")
+	flag.StringVar(&probeLocal, "probe-local", "", `additional listening address for NAT type detection, like :7778;
+for control mode only; see -probe`)
+}
+
+func checkControlFlags() error {
+	if credsFile != "" && !controlMode() {
+		return errors.New("credentials are for control mode only")
+	}
+	if stateFile != "" && !controlMode() {
+		return errors.New("state file is for control mode only")
+	}
+	if _, ok := registries[registry]; !ok {
+		return fmt.Errorf("unknown registry %q", registry)
+	}
+	if len(siblings) > 0 && !controlMode() {
+		return errors.New("siblings are for control mode only")
+	}
+	if len(siblings) > 0 && ctrlSecret == "" {
+		return errors.New("cluster requires control secret")
+	}
+	if slotTTL <= 0 {
+		return errors.New("slot TTL has to be positive")
+	}
+	if rateLimit < 0 || rateBurst < 1 || rateTotal < 0 {
+		return errors.New("invalid rate limits")
+	}
+	return nil
+}
+
+func setupClientFlags() {
+	flag.Var(&remoteAddr, "remote", `public address of control node; for peer-mode only; it can be repeated or comma-separated:
+peer announces itself to all control nodes at once; in probe mode at least two addresses are required, see -probe`)
+	flag.BoolVar(&localCands, "local-candidates", false, `announce private addresses and try to reach peer by its private addresses too;
+it helps peers behind the same NAT; for peer-mode only`)
+	flag.DurationVar(&keepalive, "keepalive", 0, `keep punched socket open and send keepalives to peer with this interval, like 5s,
+until hand-off (see -handoff); the result is printed right after punching; for peer-mode only`)
+	flag.DurationVar(&kaTimeout, "keepalive-timeout", 30*time.Second, "give up if peer's keepalives don't come during this time; see -keepalive")
+	flag.StringVar(&handoff, "handoff", "stdin", `hand-off signal that stops keepalives, see -keepalive:
+stdin: stdin is closed
+file:PATH: file PATH appears
+command (see -command) is executed right after hand-off`)
+	flag.BoolVar(&probe, "probe", false, `detect NAT type and exit; -remote is comma-separated list of at least two control nodes,
+like 2.3.3.3:7777,2.3.3.3:7778; the more different IPs and ports, the more precise the result`)
+	flag.IntVar(&predictWin, "predict-ports", 0, `announce this number of predicted ports, it helps to punch symmetric NAT;
+opposite peer sprays pings across them; 0 means no prediction; requires -predict-remote; for peer-mode only`)
+	flag.StringVar(&predictVia, "predict-remote", "", `comma-separated list of extra control node addresses to detect port allocation step,
+like 2.3.3.3:7778 (see -probe-local); see -predict-ports`)
+	flag.IntVar(&groupSize, "group", 0, `join group session of this number of members and punch holes to all other members;
+peer name has to look like session:side; result is printed for every member, template field {{.Peer}} shows its name`)
+	flag.IntVar(&maxCycles, "max-cycles", 0, "give up after this number of discovery cycles; 0 means no limit; for peer-mode only")
+	flag.DurationVar(&timeout, "timeout", 0, "give up after this time, like 5m; 0 means no limit; for peer-mode only")
+	flag.Func("backoff", `retry schedule of client phase: phase=retries,delay[,multiplier[,jitter[,max-delay]]]
+phases: discovery, ping, pong, close, sleep; the flag can be repeated
+example: -backoff ping=30,100ms,1.5,0.2,2s -backoff sleep=1,5s`, func(v string) error {
+		opt, err := parseBackoff(v)
+		if err != nil {
+			return err
+		}
+		schedule = append(schedule, opt)
+		return nil
+	})
+}
+
+func checkClientFlags() error {
+	if probe && len(remoteAddr) < 2 {
+		return errors.New("you have to specify at least two remote addresses in probe mode")
+	}
+	if controlMode() && len(remoteAddr) > 0 {
+		return errors.New("you do not have to specify remote address in control mode")
+	}
+	if role != "" && len(remoteAddr) == 0 {
+		return fmt.Errorf("you have to specify remote address in peer mode role %q", role)
+	}
+	if maxCycles < 0 || timeout < 0 || keepalive < 0 || kaTimeout < 0 {
+		return errors.New("limits and intervals can not be negative")
+	}
+	if keepalive > 0 && kaTimeout <= keepalive {
+		return errors.New("keepalive timeout has to be longer than keepalive interval")
+	}
+	if handoff != "stdin" && !strings.HasPrefix(handoff, "file:") {
+		return fmt.Errorf("invalid hand-off %q: stdin or file:PATH expected", handoff)
+	}
+	if predictWin < 0 || (predictWin > 0 && predictVia == "") {
+		return errors.New("invalid port prediction settings: positive -predict-ports and -predict-remote expected")
+	}
+	return checkGroupFlags()
+}
+
+func checkGroupFlags() error {
+	if groupSize != 0 && (role == "" || probe) {
+		return errors.New("group is for peer mode only")
+	}
+	if groupSize != 0 && (command != "" || keepalive > 0 || relayAfter > 0 || predictWin > 0) {
+		return errors.New("group can not be used with command, keepalive, relay and port prediction")
+	}
+	return nil
+}
+
+func setupRelayFlags() {
+	flag.IntVar(&relayAfter, "relay-after", 0, `ask control node for relay after this number of failed punching cycles;
+0 means never; for peer-mode only; template field {{.Path}} shows whether the path is direct or relayed`)
+	flag.StringVar(&relayPorts, "relay-ports", "", `enable relay and allocate relay ports from range, like 20000-20100, or 0 for ephemeral ports;
+for control mode only; see -relay-after`)
+	flag.DurationVar(&relayIdle, "relay-idle", time.Minute, "release relay after this idle time, one second at least; see -relay-ports")
+}
+
+func checkRelayFlags() error {
+	if relayAfter < 0 || relayIdle < time.Second {
+		return errors.New("invalid relay settings")
+	}
+	_, _, err := parsePortRange(relayPorts)
+	return err
+}
+
+func setupCommandFlags() {
 	flag.StringVar(&templateFile, "template-file", "", "template file; see -template")
 	flag.StringVar(&templateText, "template", "", "template text; see -template-file")
 	flag.StringVar(&command, "command", "", "command to execute right after the hole gets ready;\nsee -arg, -fields and -raw")
@@ -96,6 +387,24 @@ in peer mode it is outgoing address`)
 		commandArgs = append(commandArgs, cliArgument{raw: v}) //nolint:exhaustruct
 		return nil
 	})
+}
+
+func readTemplate() error {
+	var err error
+	if templateText == "" {
+		templateText, err = readFile(templateFile, defaultTemplate)
+		if err != nil {
+			return err
+		}
+	}
+	templateObj, err = template.New("main").Parse(templateText)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func setupUsage() {
 	defaultUsage := flag.Usage
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Version: %s\n", version)
@@ -107,28 +416,80 @@ First peer: peer mode (run in private network, peer a):
         %[1]s -peer a -secret TheSecretWord -remote 2.3.3.3:7777 -local :1194
 Second peer: peer mode (run in private network, peer b):
         %[1]s -peer b -secret TheSecretWord -remote 2.3.3.3:7777 -local :1194
+NAT type detection (control node listens on two ports: -local :7777 -probe-local :7778):
+        %[1]s -probe -secret TheSecretWord -remote 2.3.3.3:7777,2.3.3.3:7778 -local :1194
+Named session (run on two peers):
+        %[1]s -peer office-vpn:left -secret TheSecretWord -remote 2.3.3.3:7777 -local :1194
+        %[1]s -peer office-vpn:right -secret TheSecretWord -remote 2.3.3.3:7777 -local :1194
 `, path.Base(os.Args[0]))
 		fmt.Fprintf(flag.CommandLine.Output(), "Default template is:\n        %s\n", strings.TrimSpace(defaultTemplate))
 		fmt.Fprintln(flag.CommandLine.Output(), "Project home: https://github.com/michurin/netpunch")
 	}
+}
 
-	flag.Parse()
-
-	secret, err = readFile(secretFile, secret)
+func parseBackoff(v string) (netpunchlib.Option, error) {
+	name, spec, ok := strings.Cut(v, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid backoff %q: phase=retries,delay[,multiplier[,jitter[,max-delay]]] expected", v)
+	}
+	phase, err := netpunchlib.ParsePhase(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if templateText == "" {
-		templateText, err = readFile(templateFile, defaultTemplate)
+	flds := strings.Split(spec, ",")
+	if len(flds) < 2 || len(flds) > 5 {
+		return nil, fmt.Errorf("invalid backoff %q: from two to five fields expected", v)
+	}
+	backoff := netpunchlib.Backoff{} //nolint:exhaustruct
+	backoff.Retries, err = strconv.Atoi(flds[0])
+	if err != nil || backoff.Retries < 1 {
+		return nil, fmt.Errorf("invalid backoff %q: invalid retries: %q", v, flds[0])
+	}
+	backoff.Delay, err = time.ParseDuration(flds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid backoff %q: %w", v, err)
+	}
+	if len(flds) > 2 {
+		backoff.Multiplier, err = strconv.ParseFloat(flds[2], 64)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid backoff %q: %w", v, err)
 		}
 	}
-	templateObj, err = template.New("main").Parse(templateText)
+	if len(flds) > 3 {
+		backoff.Jitter, err = strconv.ParseFloat(flds[3], 64)
+		if err != nil || backoff.Jitter < 0 || backoff.Jitter > 1 {
+			return nil, fmt.Errorf("invalid backoff %q: jitter has to be from 0 to 1: %q", v, flds[3])
+		}
+	}
+	if len(flds) > 4 {
+		backoff.MaxDelay, err = time.ParseDuration(flds[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid backoff %q: %w", v, err)
+		}
+	}
+	return netpunchlib.ScheduleOption(phase, backoff), nil
+}
+
+func parsePortRange(v string) (int, int, error) {
+	if v == "" || v == "0" {
+		return 0, 0, nil
+	}
+	a, b, ok := strings.Cut(v, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q: MIN-MAX expected", v)
+	}
+	minPort, err := strconv.Atoi(a)
 	if err != nil {
-		return err
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", v, err)
 	}
-	return nil
+	maxPort, err := strconv.Atoi(b)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", v, err)
+	}
+	if minPort <= 0 || maxPort > 0xffff || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %q", v)
+	}
+	return minPort, maxPort, nil
 }
 
 func readFile(fn, def string) (string, error) {
@@ -143,25 +504,53 @@ func readFile(fn, def string) (string, error) {
 }
 
 func checkFlags() error {
-	messages := []string(nil)
-	if role == "" && remoteAddr != "" {
-		messages = append(messages, "you do not have to specify remote address in control mode")
-	}
-	if role != "" && remoteAddr == "" {
-		messages = append(messages, fmt.Sprintf("you have to specify remote address in peer mode role %q", role))
-	}
-	if secret == "" {
-		messages = append(messages, "you have to specify secret")
-	}
-	if localAddr == "" {
-		messages = append(messages, "you have to specify local address")
+	return errors.Join(checkCommonFlags(), checkCryptoFlags(), checkControlFlags(), checkClientFlags(), checkRelayFlags())
+}
+
+// controlMode reports whether we run in control mode: neither peer nor probe.
+func controlMode() bool {
+	return role == "" && !probe
+}
+
+func generateKey(fn string) error {
+	priv, pub, err := netpunchlib.GenerateKey()
+	if err != nil {
+		return err
 	}
-	if messages != nil {
-		return errors.New(strings.Join(messages, "; "))
+	err = os.WriteFile(fn, []byte(priv+"\n"), 0o600)
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(fn+".pub", []byte(pub+"\n"), 0o644) //nolint:gosec // it is public
+}
+
+// listFlag is flag, that can be repeated; every value can be comma-separated list as well.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, strings.Split(v, ",")...)
 	return nil
 }
 
+// registries are implementations of registry, that can be chosen by -registry flag.
+// Builds with other registries (see netpunchlib.Registry) add them here.
+var registries = map[string]func(ttl time.Duration) netpunchlib.Registry{
+	"memory": func(ttl time.Duration) netpunchlib.Registry { return netpunchlib.NewMemoryRegistry(ttl) },
+}
+
+func registryNames() []string {
+	names := []string(nil)
+	for n := range registries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func helpAndExitIfError(err error) {
 	if err == nil {
 		return
@@ -186,16 +575,24 @@ type templateDTO struct {
 	RemoteAddr string
 	RemoteIP   string
 	RemotePort string
+	Path       string // direct or relayed
+	Peer       string // name of group member, see -group
 }
 
-func buildTemplateDTO(laddr, addr *net.UDPAddr) templateDTO {
+func buildTemplateDTO(path *netpunchlib.Path) templateDTO {
+	pathType := "direct"
+	if path.Relayed {
+		pathType = "relayed"
+	}
 	return templateDTO{
-		LocalAddr:  laddr.String(),
-		LocalIP:    safeIP(laddr.IP),
-		LocalPort:  strconv.Itoa(laddr.Port),
-		RemoteAddr: addr.String(),
-		RemoteIP:   safeIP(addr.IP),
-		RemotePort: strconv.Itoa(addr.Port),
+		LocalAddr:  path.LocalAddr.String(),
+		LocalIP:    safeIP(path.LocalAddr.IP),
+		LocalPort:  strconv.Itoa(path.LocalAddr.Port),
+		RemoteAddr: path.RemoteAddr.String(),
+		RemoteIP:   safeIP(path.RemoteAddr.IP),
+		RemotePort: strconv.Itoa(path.RemoteAddr.Port),
+		Path:       pathType,
+		Peer:       "",
 	}
 }
 
@@ -235,6 +632,90 @@ func executeCommand(logger *log.Logger, dto templateDTO) error {
 	return nil
 }
 
+func handoffSignal() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if fn, ok := strings.CutPrefix(handoff, "file:"); ok {
+			for {
+				if _, err := os.Stat(fn); err == nil {
+					return
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+		}
+		_, _ = io.Copy(io.Discard, os.Stdin)
+	}()
+	return done
+}
+
+// punchAndKeepalive punches, prints result and keeps NAT mapping alive until hand-off.
+func punchAndKeepalive(ctx context.Context, logger *log.Logger, opts []netpunchlib.Option) (templateDTO, error) {
+	conn, path, err := netpunchlib.ClientConn(ctx, role, localAddr, remoteAddr[0], append(opts, netpunchlib.KeepMiddlewareOption())...)
+	if err != nil {
+		return templateDTO{}, err
+	}
+	defer conn.Close()
+	dto := buildTemplateDTO(path)
+	err = printResult(dto)
+	if err != nil {
+		return templateDTO{}, err
+	}
+	logger.Print("[info] Keep alive until hand-off: " + handoff)
+	err = netpunchlib.Keepalive(ctx, conn, path.RemoteAddr, keepalive, kaTimeout, handoffSignal())
+	if err != nil {
+		return templateDTO{}, err
+	}
+	logger.Print("[info] Hand-off")
+	return dto, nil
+}
+
+// punchGroup punches holes to all other members of group and prints result for every member.
+func punchGroup(ctx context.Context, opts []netpunchlib.Option) error {
+	laddr, err := net.ResolveUDPAddr(network, localAddr)
+	if err != nil {
+		return err
+	}
+	peers, err := netpunchlib.ClientGroup(ctx, role, localAddr, remoteAddr[0], groupSize, opts...)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dto := buildTemplateDTO(&netpunchlib.Path{LocalAddr: laddr, RemoteAddr: peers[name], Relayed: false})
+		dto.Peer = name
+		err = printResult(dto)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func probeNAT(ctx context.Context, opts []netpunchlib.Option) error {
+	res, err := netpunchlib.Probe(ctx, localAddr, remoteAddr, opts...)
+	if err != nil {
+		return err
+	}
+	partial := ""
+	if res.Partial {
+		partial = " (partial: all control nodes have the same IP)"
+	}
+	fmt.Printf("NAT: %s%s\n", res.Type, partial)
+	for i, m := range res.Mapped {
+		mapped := "n/a"
+		if m != nil {
+			mapped = m.String()
+		}
+		fmt.Printf("MAPPED: %s %s\n", remoteAddr[i], mapped)
+	}
+	return nil
+}
+
 func printResult(dto templateDTO) error {
 	return templateObj.Execute(os.Stdout, dto)
 }
@@ -246,12 +727,171 @@ func logWriter() io.Writer {
 	return os.Stderr
 }
 
-func connectionOptions(loggingMiddleware, signingMiddleware netpunchlib.ConnectionMiddleware) netpunchlib.Option {
+// secureMiddleware signs (or encrypts, see -encrypt) messages by secret and protects them from replays.
+// If private key is specified, secret is ignored, messages are verified by trusted keys.
+func secureMiddleware(secret []byte) netpunchlib.ConnectionMiddleware {
+	mw := netpunchlib.SigningMiddleware(secret)
+	if privateKey != nil {
+		mw = netpunchlib.PublicKeySigningMiddleware(privateKey, trustedKeys...)
+	}
+	if encrypt {
+		mw = netpunchlib.EncryptionMiddleware(secret) // it authenticates messages too
+	}
+	return protectReplays(mw)
+}
+
+func protectReplays(mw netpunchlib.ConnectionMiddleware) netpunchlib.ConnectionMiddleware {
+	if replayWin > 0 {
+		return netpunchlib.ChainMiddleware(mw, netpunchlib.ReplayProtectionMiddleware(replayWin, 0)) // signature covers timestamp and nonce
+	}
+	return mw
+}
+
+// reloadKeys re-reads list of keys from keys file on SIGHUP, so keys can be rotated without restart.
+// Old keys are kept if new list is invalid.
+func reloadKeys(ctx context.Context, logger *log.Logger, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		err := loadKeys()
+		if err != nil {
+			logger.Printf("[error] Keys are not reloaded, old ones are kept: %s: %s", keysFile, err)
+			continue
+		}
+		logger.Print("[info] Keys are reloaded from " + keysFile)
+	}
+}
+
+func loadKeys() error {
+	keys, err := readKeys()
+	if err != nil {
+		return err
+	}
+	return keyring.Set(keys...)
+}
+
+func readKeys() ([]netpunchlib.Key, error) {
+	f, err := os.Open(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return netpunchlib.ParseKeys(f)
+}
+
+func connectionMiddlewares(loggingMiddleware, secureMiddleware netpunchlib.ConnectionMiddleware) []netpunchlib.ConnectionMiddleware {
 	if rawMode {
-		return netpunchlib.ConnOption(loggingMiddleware, signingMiddleware) // put logging first
+		return []netpunchlib.ConnectionMiddleware{loggingMiddleware, secureMiddleware} // put logging first
 	} else { //nolint:revive
-		return netpunchlib.ConnOption(signingMiddleware, loggingMiddleware) // put logging last
+		return []netpunchlib.ConnectionMiddleware{secureMiddleware, loggingMiddleware} // put logging last
+	}
+}
+
+// securityOptions builds options of middlewares for messages exchanged with peers and with control nodes.
+func securityOptions(ctx context.Context, logger *log.Logger) (netpunchlib.Option, netpunchlib.Option, error) {
+	loggingMiddleware := netpunchlib.LoggingMiddleware(logger)
+	secure := secureMiddleware(nil)
+	if privateKey == nil {
+		secure = secureMiddleware([]byte(secret))
+	}
+	if keyring != nil {
+		secure = protectReplays(netpunchlib.KeyringSigningMiddleware(keyring))
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP) // subscribe right now, default action of SIGHUP is to terminate
+		go reloadKeys(ctx, logger, hup)
+	}
+	if credsFile != "" {
+		creds, err := netpunchlib.LoadCredentials(credsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		secure = netpunchlib.CredentialsMiddleware(creds, secureMiddleware)
+		if privateKey != nil { // credentials are public keys, check them all right now
+			keys, err := creds.PublicKeys()
+			if err != nil {
+				return nil, nil, err
+			}
+			secure = netpunchlib.CredentialsMiddleware(creds, func(secret []byte) netpunchlib.ConnectionMiddleware {
+				return protectReplays(netpunchlib.PublicKeySigningMiddleware(privateKey, keys[string(secret)]))
+			})
+		}
 	}
+	connOption := netpunchlib.ConnOption(connectionMiddlewares(loggingMiddleware, secure)...)
+	ctrlOption := netpunchlib.ControlConnOption() // no middlewares: control node and peer share the same chain
+	if ctrlSecret != "" {
+		ctrlOption = netpunchlib.ControlConnOption(connectionMiddlewares(loggingMiddleware, secureMiddleware([]byte(ctrlSecret)))...)
+	}
+	return connOption, ctrlOption, nil
+}
+
+func runControl(ctx context.Context, logger *log.Logger, connOption, ctrlOption, netOption netpunchlib.Option) error {
+	logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
+	logger.Print("[info] Start in control mode on " + localAddr)
+	rateOption := netpunchlib.ConnOption() // it goes first, so excess packets cost no cryptography
+	if rateLimit > 0 || rateTotal > 0 {
+		rateOption = netpunchlib.ConnOption(netpunchlib.RateLimitMiddleware(rateLimit, rateBurst, rateTotal))
+	}
+	opts := []netpunchlib.Option{rateOption, connOption, netOption, netpunchlib.SlotTTLOption(slotTTL),
+		netpunchlib.RegistryOption(registries[registry])}
+	if consumeOnce {
+		opts = append(opts, netpunchlib.ConsumeOnceOption())
+	}
+	if stateFile != "" {
+		opts = append(opts, netpunchlib.StateStoreOption(netpunchlib.NewFileStore(stateFile)))
+	}
+	if len(siblings) > 0 {
+		opts = append(opts, ctrlOption, netpunchlib.ClusterOption(siblings...)) // siblings are not rate limited
+	}
+	if relayPorts != "" {
+		minPort, maxPort, _ := parsePortRange(relayPorts) // checked in checkRelayFlags
+		opts = append(opts, netpunchlib.RelayOption(minPort, maxPort, relayIdle))
+	}
+	if probeLocal != "" {
+		logger.Print("[info] Listen for NAT type detection on " + probeLocal)
+		go func() {
+			helpAndExitIfError(netpunchlib.Server(ctx, probeLocal, rateOption, connOption, netOption))
+		}()
+	}
+	return netpunchlib.Server(ctx, localAddr, opts...)
+}
+
+func runPeer(ctx context.Context, logger *log.Logger, connOption, ctrlOption, netOption netpunchlib.Option) error {
+	logger.SetPrefix(fmt.Sprintf("[%d] [%s] ", os.Getpid(), role))
+	logger.Print("[info] Start in peer mode on " + localAddr + " to server at " + remoteAddr.String())
+	opts := append(append([]netpunchlib.Option(nil), schedule...), connOption, ctrlOption, netOption,
+		netpunchlib.MaxCyclesOption(maxCycles), netpunchlib.TimeoutOption(timeout), netpunchlib.RelayAfterOption(relayAfter))
+	if len(remoteAddr) > 1 {
+		opts = append(opts, netpunchlib.ControlNodesOption(remoteAddr[1:]...))
+	}
+	if localCands {
+		opts = append(opts, netpunchlib.LocalCandidatesOption())
+	}
+	if predictWin > 0 {
+		opts = append(opts, netpunchlib.PortPredictionOption(predictWin, strings.Split(predictVia, ",")...))
+	}
+	if groupSize > 0 {
+		return punchGroup(ctx, opts)
+	}
+	if keepalive > 0 {
+		dto, err := punchAndKeepalive(ctx, logger, opts) // socket is closed here, so command is able to bind port
+		if err != nil {
+			return err
+		}
+		return executeCommand(logger, dto)
+	}
+	path, err := netpunchlib.ClientPath(ctx, role, localAddr, remoteAddr[0], opts...) // btw, abstraction leaking (role: arg->payload)
+	if err != nil {
+		return err
+	}
+	dto := buildTemplateDTO(path)
+	err = printResult(dto)
+	if err != nil {
+		return err
+	}
+	return executeCommand(logger, dto)
 }
 
 func main() {
@@ -261,6 +901,10 @@ func main() {
 		fmt.Println(version)
 		return
 	}
+	if genKey != "" {
+		helpAndExitIfError(generateKey(genKey))
+		return
+	}
 
 	helpAndExitIfError(checkFlags())
 
@@ -278,22 +922,20 @@ func main() {
 		cancel()
 	}()
 
-	connOption := connectionOptions(
-		netpunchlib.LoggingMiddleware(logger),
-		netpunchlib.SigningMiddleware([]byte(secret)))
+	connOption, ctrlOption, err := securityOptions(ctx, logger)
+	helpAndExitIfError(err)
+	netOption := netpunchlib.NetworkOption(network)
+
+	if probe {
+		logger.SetPrefix(fmt.Sprintf("[%d] [probe] ", os.Getpid()))
+		logger.Print("[info] Start NAT type detection on " + localAddr + " to servers at " + remoteAddr.String())
+		helpAndExitIfError(probeNAT(ctx, append(append([]netpunchlib.Option(nil), schedule...), connOption, ctrlOption, netOption)))
+		return
+	}
 
 	if role == "" {
-		logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
-		logger.Print("[info] Start in control mode on " + localAddr)
-		err := netpunchlib.Server(ctx, localAddr, connOption)
-		helpAndExitIfError(err)
+		helpAndExitIfError(runControl(ctx, logger, connOption, ctrlOption, netOption))
 	} else {
-		logger.SetPrefix(fmt.Sprintf("[%d] [%s] ", os.Getpid(), role))
-		logger.Print("[info] Start in peer mode on " + localAddr + " to server at " + remoteAddr)
-		laddr, addr, err := netpunchlib.Client(ctx, role, localAddr, remoteAddr, connOption) // btw, abstraction leaking (role: arg->payload)
-		helpAndExitIfError(err)
-		dto := buildTemplateDTO(laddr, addr)
-		helpAndExitIfError(printResult(dto))
-		helpAndExitIfError(executeCommand(logger, dto))
+		helpAndExitIfError(runPeer(ctx, logger, connOption, ctrlOption, netOption))
 	}
 }
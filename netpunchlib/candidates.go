@@ -0,0 +1,95 @@
+package netpunchlib
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const maxLocalCandidates = 8
+
+// localCandidates returns local addresses that the peer, sitting in the same private network, can reach us at.
+// Only private addresses are announced, control node drops the others anyway, see privateAddr.
+func localCandidates(network string, laddr *net.UDPAddr, port int) []string {
+	ips := []net.IP(nil)
+	if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		ips = append(ips, laddr.IP) // socket is bound to particular address
+	} else {
+		ifAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil // it is not fatal, we just do not know local addresses
+		}
+		for _, a := range ifAddrs {
+			if n, ok := a.(*net.IPNet); ok {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	addrs := []string(nil)
+	for _, ip := range ips {
+		if !ip.IsPrivate() {
+			continue
+		}
+		addr := &net.UDPAddr{IP: ip, Port: port} //nolint:exhaustruct
+		if !reachable(network, laddr, addr) {
+			continue
+		}
+		addrs = append(addrs, addr.String())
+		if len(addrs) == maxLocalCandidates {
+			break
+		}
+	}
+	return addrs
+}
+
+// sanitizeCandidates drops everything except valid literal addresses, that are allowed, and keeps no more than limit addresses.
+// Server uses it to avoid forwarding garbage from one peer to another, and to avoid turning peers into reflectors,
+// that spray pings at third-party addresses.
+func sanitizeCandidates(s string, limit int, allowed func(netip.Addr) bool) string {
+	addrs := []string(nil)
+	for _, a := range strings.Split(s, string(addrsSeparator)) {
+		ap, err := netip.ParseAddrPort(a)
+		if err != nil || !ap.IsValid() || ap.Port() == 0 || !allowed(ap.Addr().Unmap()) {
+			continue
+		}
+		addrs = append(addrs, ap.String())
+		if len(addrs) == limit {
+			break
+		}
+	}
+	return strings.Join(addrs, string(addrsSeparator))
+}
+
+// mergeCandidates appends addresses that are not known yet.
+func mergeCandidates(addrs []*net.UDPAddr, more ...*net.UDPAddr) []*net.UDPAddr {
+	for _, m := range more {
+		known := false
+		for _, a := range addrs {
+			if a.IP.Equal(m.IP) && a.Port == m.Port {
+				known = true
+				break
+			}
+		}
+		if !known {
+			addrs = append(addrs, m)
+		}
+	}
+	return addrs
+}
+
+// privateAddr allows local candidates: peers behind the same NAT share private network.
+func privateAddr(ip netip.Addr) bool {
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// sameIP allows predicted candidates: they are ports of the same NAT, that announce comes from.
+func sameIP(ips ...net.IP) func(netip.Addr) bool {
+	return func(ip netip.Addr) bool {
+		for _, a := range ips {
+			if a.Equal(ip.AsSlice()) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -3,185 +3,549 @@ package netpunchlib
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
-type modeInfo struct {
-	retrys  int
-	delay   time.Duration
-	message []byte
+var modeLabels = map[Phase]byte{ //nolint:gochecknoglobals
+	PhaseDiscovering: 0, // server message
+	PhasePinging:     labelPing,
+	PhasePonging:     labelPong,
+	PhaseClosing:     labelClose,
+	PhaseSleeping:    0, // not used
 }
 
-const (
-	modeDiscovering = iota
-	modePinging
-	modePonging
-	modeClosing
-	modeSleeping
-)
+var handshakeLabels = []byte{labelPing, labelPong, labelClose} //nolint:gochecknoglobals
+
+// peerIdentity is name and per-run nonce of peer. Server distributes it in peer info,
+// and peers put it into handshake messages: label|name|nonce.
+type peerIdentity struct {
+	name  string
+	nonce string
+}
+
+func (p peerIdentity) message(label byte) []byte {
+	return bytes.Join([][]byte{{label}, []byte(p.name), []byte(p.nonce)}, []byte{labelsSeporator})
+}
 
-var modes = map[int]modeInfo{ //nolint:gochecknoglobals
-	modeDiscovering: {
-		retrys:  5,
-		delay:   100 * time.Millisecond,
-		message: nil,
-	},
-	modePinging: {
-		retrys:  10,
-		delay:   100 * time.Millisecond,
-		message: []byte{labelPing},
-	},
-	modePonging: {
-		retrys:  10,
-		delay:   100 * time.Millisecond,
-		message: []byte{labelPong},
-	},
-	modeClosing: {
-		retrys:  5,
-		delay:   20 * time.Millisecond,
-		message: []byte{labelClose},
-	},
-	modeSleeping: {
-		retrys:  1,
-		delay:   30 * time.Second,
-		message: nil, // not used
-	},
+// is checks whether handshake message comes from this peer.
+func (p peerIdentity) is(flds [][]byte) bool {
+	return p.name != "" && len(flds) == 3 && string(flds[1]) == p.name && string(flds[2]) == p.nonce
 }
 
 func processor(
 	conn ConnectionWriter,
-	serverAddr *net.UDPAddr,
+	config *Config,
+	laddr *net.UDPAddr,
+	serverAddrs []*net.UDPAddr,
+	self peerIdentity,
 	serverMessage []byte,
+	relayMessage []byte, // nil if relay is not allowed
+	doneMessage []byte, // nil if pairing is not confirmed
 	serverDataChan <-chan receivedMessage,
 	serverErrChan <-chan error,
-	addrChan chan<- *net.UDPAddr,
+	deadline time.Time, // zero means no deadline, see Config.deadline
+	pathChan chan<- *Path,
 	errChan chan<- error,
 ) {
-	var err error
-	var peerAddr *net.UDPAddr
-	mode := modeDiscovering
-	tryCount := 0
+	fsm := &punchFSM{
+		conn:          conn,
+		config:        config,
+		laddr:         laddr,
+		serverAddrs:   serverAddrs,
+		self:          self,
+		serverMessage: serverMessage,
+		relayMessage:  relayMessage,
+		doneMessage:   doneMessage,
+		pathChan:      pathChan,
+		errChan:       errChan,
+		candidates:    nil,
+		peer:          peerIdentity{name: "", nonce: ""},
+		peerAddr:      nil,
+		relayAddr:     nil,
+		mode:          PhaseDiscovering,
+		reached:       PhaseDiscovering,
+		cycles:        1,
+		failedPunches: 0,
+		tryCount:      0,
+	}
+	var timeout <-chan time.Time // nil channel blocks forever
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var retry <-chan time.Time // nil means we have to (re)send message
 	for {
-		tryCount++
-		minfo := modes[mode]
-		if mode != modeSleeping {
-			msg := minfo.message
-			addr := peerAddr
-			if msg == nil {
-				msg = serverMessage
-				addr = serverAddr
-			}
-			_, err = conn.WriteToUDP(msg, addr)
-			if err != nil {
-				errChan <- err
+		if retry == nil {
+			if fsm.send() {
 				return
 			}
+			retry = time.After(config.schedule[fsm.mode].delay(fsm.tryCount))
 		}
 		select {
-		case <-time.After(minfo.delay):
-			if tryCount >= minfo.retrys { // perform transition if count of tries exhausted
-				switch mode { // sort of FSM transition table
-				case modeClosing:
-					addrChan <- peerAddr
-					return
-				case modeSleeping:
-					mode = modeDiscovering
-				default:
-					mode = modeSleeping
-				}
-				tryCount = 0
+		case <-retry:
+			retry = nil
+			if fsm.onRetry() {
+				return
 			}
 		case data := <-serverDataChan:
-			if len(data.message) == 0 {
-				break // ignore empty messages
-			}
-			switch data.message[0] {
-			case labelPeerInfo:
-				flds := bytes.Split(data.message, []byte{labelsSeporator})
-				if len(flds) != 3 {
-					break // ignore invalid messages
-				}
-				peerAddr, err = net.ResolveUDPAddr("udp", string(flds[2]))
-				if err != nil {
-					errChan <- err
-					return
-				}
-				mode = modePinging // start pinging
-			case labelPing:
-				peerAddr = data.addr // ping can come before first peer info response
-				mode = modePonging
-			case labelPong:
-				peerAddr = data.addr // and pong can too
-				mode = modeClosing
-			case labelClose:
-				addrChan <- peerAddr
+			prev := fsm.mode
+			if fsm.onMessage(data) {
 				return
 			}
-			tryCount = 0
+			if fsm.mode != prev { // duplicates must not affect retries, otherwise chatty peer makes us retry forever
+				retry = nil // send message of new mode right now
+				fsm.tryCount = 0
+			}
 		case err := <-serverErrChan:
-			errChan <- err
+			fsm.errChan <- err
 			return
+		case <-timeout:
+			fsm.errChan <- &PunchError{Phase: fsm.reached, Err: ErrTimeout}
+			return
+		}
+	}
+}
+
+// punchFSM is state of processor. All its handlers report whether processor has finished:
+// result is sent to pathChan or errChan already.
+type punchFSM struct {
+	conn          ConnectionWriter
+	config        *Config
+	laddr         *net.UDPAddr
+	serverAddrs   []*net.UDPAddr
+	self          peerIdentity
+	serverMessage []byte
+	relayMessage  []byte // nil if relay is not allowed
+	doneMessage   []byte // nil if pairing is not confirmed
+	pathChan      chan<- *Path
+	errChan       chan<- error
+	candidates    []*net.UDPAddr // peer addresses we got from server
+	peer          peerIdentity   // expected peer, we got it from server
+	peerAddr      *net.UDPAddr   // peer address that responded
+	relayAddr     *net.UDPAddr   // relay address we got from server
+	mode          Phase
+	reached       Phase // the most advanced phase
+	cycles        int
+	failedPunches int
+	tryCount      int
+}
+
+// send sends message of current mode.
+func (f *punchFSM) send() bool {
+	if f.mode > f.reached && f.mode != PhaseSleeping {
+		f.reached = f.mode
+	}
+	f.tryCount++
+	if f.mode == PhaseSleeping {
+		return false
+	}
+	msg := f.self.message(modeLabels[f.mode])
+	addrs := []*net.UDPAddr{f.peerAddr}
+	switch f.mode {
+	case PhaseDiscovering:
+		msg = f.serverMessage
+		if f.relayMessage != nil && f.failedPunches >= f.config.relayAfter {
+			msg = f.relayMessage
+		}
+		addrs = f.serverAddrs
+	case PhasePinging:
+		addrs = pingTargets(f.candidates, f.tryCount)
+	}
+	err := writeAll(f.conn, msg, addrs)
+	if err != nil {
+		f.errChan <- err
+		return true
+	}
+	return false
+}
+
+// onRetry performs transition if count of tries exhausted.
+func (f *punchFSM) onRetry() bool {
+	if f.tryCount < f.config.schedule[f.mode].retries() {
+		return false
+	}
+	switch f.mode { // sort of FSM transition table
+	case PhaseClosing:
+		f.finish()
+		return true
+	case PhaseSleeping:
+		f.mode = PhaseDiscovering
+		f.cycles++
+	default:
+		if f.mode != PhaseDiscovering {
+			f.failedPunches++
+		}
+		if f.config.maxCycles > 0 && f.cycles >= f.config.maxCycles { // do not sleep in vain
+			f.errChan <- giveUpError(f.reached, f.candidates != nil || f.peerAddr != nil)
+			return true
+		}
+		f.mode = PhaseSleeping
+	}
+	f.tryCount = 0
+	return false
+}
+
+// onMessage handles messages of server and peer; invalid and unknown messages are ignored.
+func (f *punchFSM) onMessage(data receivedMessage) bool {
+	if len(data.message) == 0 {
+		return false
+	}
+	flds := bytes.Split(data.message, []byte{labelsSeporator})
+	if bytes.IndexByte(handshakeLabels, data.message[0]) >= 0 && !f.peer.is(flds) {
+		return false // ignore strangers and previous runs of peer, as well as peer we haven't heard about yet
+	}
+	switch data.message[0] {
+	case labelPeerInfo:
+		f.onPeerInfo(flds)
+	case labelRelayInfo:
+		f.onRelayInfo(data.addr, flds)
+	case labelPing:
+		f.peerAddr = data.addr // it can differ from candidates, e.g. predicted port
+		f.mode = advance(f.mode, PhasePonging)
+	case labelPong:
+		f.peerAddr = data.addr // lock onto the address that answered
+		f.mode = advance(f.mode, PhaseClosing)
+	case labelClose:
+		f.finish()
+		return true
+	}
+	return false
+}
+
+func (f *punchFSM) onPeerInfo(flds [][]byte) {
+	if f.mode != PhaseDiscovering && f.mode != PhaseSleeping {
+		return // the first reply wins, late replies of other control nodes must not switch peer
+	}
+	if len(flds) < 5 || len(flds) > 7 || !validNonce(string(flds[2])) {
+		return
+	}
+	if age, err := strconv.Atoi(string(flds[3])); err != nil || age < 0 {
+		return
+	}
+	addrs := parseAddrs(f.config.network, f.laddr, string(flds[4]))
+	if len(flds) >= 6 && f.config.local {
+		addrs = mergeCandidates(addrs, parseAddrs(f.config.network, f.laddr, string(flds[5]))...)
+	}
+	if len(flds) == 7 { // peer is behind symmetric NAT, spray pings across predicted ports
+		addrs = mergeCandidates(addrs, parseAddrs(f.config.network, f.laddr, string(flds[6]))...)
+	}
+	if len(addrs) == 0 {
+		return // ignore peers we can not reach
+	}
+	f.peer = peerIdentity{name: string(flds[1]), nonce: string(flds[2])}
+	f.candidates = addrs
+	f.mode = advance(f.mode, PhasePinging) // start pinging
+}
+
+func (f *punchFSM) onRelayInfo(addr *net.UDPAddr, flds [][]byte) {
+	if len(flds) != 4 || f.relayMessage == nil || !validNonce(string(flds[2])) {
+		return // ignore unexpected messages as well
+	}
+	port, err := strconv.Atoi(string(flds[3]))
+	if err != nil || port <= 0 || port > 0xffff {
+		return
+	}
+	f.peer = peerIdentity{name: string(flds[1]), nonce: string(flds[2])}
+	f.relayAddr = &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone} // relay lives on server
+	f.candidates = []*net.UDPAddr{f.relayAddr}
+	f.mode = advance(f.mode, PhasePinging) // start pinging through relay
+}
+
+func (f *punchFSM) finish() {
+	confirm(f.conn, f.doneMessage, f.serverAddrs)
+	f.pathChan <- buildPath(f.peerAddr, f.relayAddr)
+}
+
+// confirm tells server that peer is paired, see ConsumeOnceOption. It is best effort:
+// if message is lost, server forgets peer by TTL anyway.
+func confirm(conn ConnectionWriter, doneMessage []byte, serverAddrs []*net.UDPAddr) {
+	if doneMessage != nil {
+		_ = writeAll(conn, doneMessage, serverAddrs)
+	}
+}
+
+func buildPath(peerAddr, relayAddr *net.UDPAddr) *Path {
+	return &Path{
+		LocalAddr:  nil, // it is not processor's business
+		RemoteAddr: peerAddr,
+		Relayed:    relayAddr != nil && peerAddr.IP.Equal(relayAddr.IP) && peerAddr.Port == relayAddr.Port,
+	}
+}
+
+// advance never moves FSM back: late pings and pongs must not interrupt closing.
+func advance(mode, next Phase) Phase {
+	if mode == PhaseSleeping || next > mode {
+		return next
+	}
+	return mode
+}
+
+// pingTargets implements sort of Happy Eyeballs: it tries IPv6 first and falls back to IPv4 on the next try.
+func pingTargets(candidates []*net.UDPAddr, tryCount int) []*net.UDPAddr {
+	if tryCount > 1 {
+		return candidates
+	}
+	targets := []*net.UDPAddr(nil)
+	for _, a := range candidates {
+		if !isIPv4(a) {
+			targets = append(targets, a)
+		}
+	}
+	if targets == nil {
+		return candidates
+	}
+	return targets
+}
+
+// writeAll sends message to all addresses; it fails only if all writes failed,
+// because, for instance, IPv6 can be unavailable on dual-stack host.
+func writeAll(conn ConnectionWriter, msg []byte, addrs []*net.UDPAddr) error {
+	var err error
+	sent := false
+	for _, addr := range addrs {
+		_, e := conn.WriteToUDP(msg, addr)
+		if e != nil {
+			err = e
+			continue
 		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+func giveUpError(reached Phase, peerKnown bool) error {
+	if !peerKnown {
+		return &PunchError{Phase: reached, Err: ErrServerUnreachable}
 	}
+	return &PunchError{Phase: reached, Err: ErrPeerUnreachable}
 }
 
-func buildMessage(s string) ([]byte, error) {
-	m := []byte(s)
-	if len(m) != 1 {
-		return nil, fmt.Errorf("invalid slot (role): %q", s)
+func checkName(name string) error {
+	_, _, err := splitName(name)
+	return err
+}
+
+func buildMessage(self peerIdentity, local, predicted []string) []byte {
+	m := self.message(labelAnnounce)
+	if len(local) > 0 || len(predicted) > 0 {
+		m = append(m, labelsSeporator)
+		m = append(m, strings.Join(local, string(addrsSeparator))...)
 	}
-	if m[0] < 'a' || m[0] > 'z' {
-		return nil, fmt.Errorf("invalid slot (role): %q", s)
+	if len(predicted) > 0 {
+		m = append(m, labelsSeporator)
+		m = append(m, strings.Join(predicted, string(addrsSeparator))...)
+	}
+	return m
+}
+
+// predictionError reports timeout of prediction like timeout of punching, see TimeoutOption.
+func predictionError(ctx context.Context, err error) error {
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return &PunchError{Phase: PhaseDiscovering, Err: ErrTimeout}
 	}
-	return m, nil
+	return err
+}
+
+// Path describes punched path.
+type Path struct {
+	LocalAddr  *net.UDPAddr
+	RemoteAddr *net.UDPAddr
+	Relayed    bool // RemoteAddr is relay on control node, see RelayAfterOption
 }
 
-func Client(ctx context.Context, slot, address, remoteAddress string, opt ...Option) (*net.UDPAddr, *net.UDPAddr, error) {
-	message, err := buildMessage(slot)
+func Client(ctx context.Context, name, address, remoteAddress string, opt ...Option) (*net.UDPAddr, *net.UDPAddr, error) {
+	path, err := ClientPath(ctx, name, address, remoteAddress, opt...)
 	if err != nil {
 		return nil, nil, err
 	}
+	return path.LocalAddr, path.RemoteAddr, nil
+}
 
-	config := newConfig(opt...)
+// ClientPath is like Client, however it reports whether the path is direct or relayed.
+func ClientPath(ctx context.Context, name, address, remoteAddress string, opt ...Option) (*Path, error) {
+	if ka := newConfig(opt...).keepalive; ka != nil {
+		err := checkKeepalive(ka.interval, ka.timeout) // don't punch in vain
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := punch(ctx, name, address, remoteAddress, opt...)
+	if err != nil {
+		return nil, err
+	}
+	if ka := res.config.keepalive; ka != nil {
+		err = Keepalive(ctx, &packetConn{next: res.conn, udp: res.udpConn}, res.path.RemoteAddr, ka.interval, ka.timeout, ka.handoff)
+		if err != nil {
+			_ = res.conn.Close()
+			return nil, err
+		}
+	}
+	_ = res.conn.Close()
+	return res.path, nil
+}
 
-	laddr, err := net.ResolveUDPAddr("udp", address)
+// ClientConn is like Client, however it doesn't close the punched socket, it hands it over to caller instead.
+// So caller is able to use it right away, without rebinding port and racing with NAT mapping expiry.
+// Returned connection is raw socket, without middlewares, unless KeepMiddlewareOption is set.
+// Keep in mind, few late handshake messages from peer can still come to the socket.
+func ClientConn(ctx context.Context, name, address, remoteAddress string, opt ...Option) (net.PacketConn, *Path, error) { //nolint:ireturn
+	res, err := punch(ctx, name, address, remoteAddress, opt...)
 	if err != nil {
 		return nil, nil, err
 	}
-	addr, err := net.ResolveUDPAddr("udp", remoteAddress)
+	if res.config.keepMW {
+		return &packetConn{next: res.conn, udp: res.udpConn}, res.path, nil
+	}
+	return res.udpConn, res.path, nil
+}
+
+type punchResult struct {
+	config  *Config
+	udpConn *net.UDPConn
+	conn    Connection // udpConn wrapped by middlewares
+	path    *Path
+}
+
+// punch returns open socket in case of success, all goroutines are stopped.
+func punch(ctx context.Context, name, address, remoteAddress string, opt ...Option) (*punchResult, error) {
+	err := checkName(name)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	udpConn, err := net.ListenUDP("udp", laddr)
+	config := newConfig(opt...)
+	err = checkNetwork(config.network)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	deadline := config.deadline()
+	predictCtx, cancelPrediction := context.WithCancel(ctx)
+	if !deadline.IsZero() { // prediction is part of punching, it must not exceed timeout
+		predictCtx, cancelPrediction = context.WithDeadline(ctx, deadline)
+	}
+	defer cancelPrediction()
+
+	laddr, err := net.ResolveUDPAddr(config.network, address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolveServers(ctx, config, laddr, remoteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	controlAddrs := addrs
+	predictTargets := []*net.UDPAddr(nil)
+	if config.predict != nil {
+		predictTargets, err = predictionTargets(predictCtx, config, laddr, addrs)
+		if err != nil {
+			return nil, predictionError(ctx, err)
+		}
+		controlAddrs = mergeCandidates(append([]*net.UDPAddr(nil), addrs...), predictTargets...)
+	}
+
+	udpConn, err := net.ListenUDP(config.network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := config.wrapClientConnection(udpConn, controlAddrs)
+	self := peerIdentity{name: name, nonce: newNonce()}
+	path, err := exchange(ctx, predictCtx, conn, udpConn, config, laddr, addrs, predictTargets, self, deadline)
+	if err != nil {
+		_ = conn.Close() // exchange has cancelled reading already, so it will be closed synchronously
+		return nil, err
+	}
+
+	return &punchResult{
+		config:  config,
+		udpConn: udpConn,
+		conn:    conn,
+		path: &Path{
+			LocalAddr:  laddr,
+			RemoteAddr: path.RemoteAddr,
+			Relayed:    path.Relayed,
+		},
+	}, nil
+}
+
+// exchange predicts ports, announces peer and punches hole through socket.
+// It stops reading on return, however it doesn't close socket, punch takes care of it.
+func exchange(
+	ctx context.Context,
+	predictCtx context.Context, // it limits prediction, see TimeoutOption
+	conn Connection,
+	udpConn *net.UDPConn, // raw socket under conn
+	config *Config,
+	laddr *net.UDPAddr,
+	serverAddrs []*net.UDPAddr,
+	predictTargets []*net.UDPAddr,
+	self peerIdentity,
+	deadline time.Time,
+) (*Path, error) {
+	local := []string(nil)
+	if config.local {
+		local = localCandidates(config.network, laddr, udpConn.LocalAddr().(*net.UDPAddr).Port) //nolint:forcetypeassert
+	}
+	relayMessage := []byte(nil)
+	if config.relayAfter > 0 {
+		relayMessage = self.message(labelRelayReq)
 	}
-	conn := config.wrapConnection(udpConn)
 	ctx, cancel := context.WithCancel(ctx)
-	defer func() {
-		cancel()         // we must to cancel first
-		_ = conn.Close() // will be closed synchronously
-	}()
+	defer cancel()
 
 	serverDataChan := make(chan receivedMessage)
 	serverErrChan := make(chan error)
+	serveDone := make(chan struct{})
 
-	go serve(ctx, conn, serverDataChan, serverErrChan)
+	go func() {
+		serve(ctx, conn, serverDataChan, serverErrChan)
+		close(serveDone)
+	}()
+
+	var err error
+	predicted := []string(nil)
+	if config.predict != nil {
+		predicted, err = predictPorts(predictCtx, conn, config, predictTargets, serverDataChan, serverErrChan)
+		if err != nil {
+			return nil, predictionError(ctx, err) // it is checked before cancellation
+		}
+	}
+	message := buildMessage(self, local, predicted)
 
-	addrChan := make(chan *net.UDPAddr)
-	errChan := make(chan error)
+	pathChan := make(chan *Path, 1) // processor must not hang, if nobody is waiting for result
+	errChan := make(chan error, 1)
 
-	go processor(conn, addr, message, serverDataChan, serverErrChan, addrChan, errChan)
+	go processor(conn, config, laddr, serverAddrs, self, message, relayMessage, self.message(labelDone),
+		serverDataChan, serverErrChan, deadline, pathChan, errChan)
 
+	var path *Path
 	select {
-	case addr := <-addrChan:
-		return laddr, addr, nil
-	case err := <-errChan:
-		return nil, nil, err
+	case path = <-pathChan:
+	case err = <-errChan:
 	case <-ctx.Done():
-		return nil, nil, ctx.Err()
+		err = ctx.Err()
+	}
+	cancel() // we must to cancel first
+	if err != nil {
+		return nil, err
+	}
+
+	// stop reading without closing socket: interrupt reading by deadline and wait for serve to exit
+	err = udpConn.SetReadDeadline(time.Now())
+	if err == nil {
+		<-serveDone
+		err = udpConn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		return nil, err
 	}
+	return path, nil
 }
@@ -0,0 +1,197 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func fastSchedule() []netpunchlib.Option {
+	fast := netpunchlib.Backoff{Retries: 2, Delay: 10 * time.Millisecond} //nolint:exhaustruct
+	return []netpunchlib.Option{
+		netpunchlib.ScheduleOption(netpunchlib.PhaseDiscovering, fast),
+		netpunchlib.ScheduleOption(netpunchlib.PhasePinging, fast),
+		netpunchlib.ScheduleOption(netpunchlib.PhasePonging, fast),
+		netpunchlib.ScheduleOption(netpunchlib.PhaseClosing, fast),
+		netpunchlib.ScheduleOption(netpunchlib.PhaseSleeping, fast),
+	}
+}
+
+// fakeServer answers on every message by given payload.
+func fakeServer(t *testing.T, payload []byte) string {
+	t.Helper()
+	return fakeServerAt(t, net.IPv4(127, 0, 0, 1), payload)
+}
+
+func fakeServerAt(t *testing.T, ip net.IP, payload []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip}) //nolint:exhaustruct
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			_, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(payload, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClient_maxCyclesServerUnreachable(t *testing.T) {
+	srv := fakeServer(t, []byte("nothing useful"))
+	start := time.Now()
+	_, _, err := netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", srv, append(fastSchedule(), netpunchlib.MaxCyclesOption(3))...)
+	require.ErrorIs(t, err, netpunchlib.ErrServerUnreachable)
+	punchErr := (*netpunchlib.PunchError)(nil)
+	require.ErrorAs(t, err, &punchErr)
+	assert.Equal(t, netpunchlib.PhaseDiscovering, punchErr.Phase)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClient_maxCyclesPeerUnreachable(t *testing.T) {
+	deadPeer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer deadPeer.Close() // it keeps port busy, but never answers
+
+	srv := fakeServer(t, []byte("i|b|0123456789abcdef|0|"+deadPeer.LocalAddr().String()))
+	_, _, err = netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", srv, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...)
+	require.ErrorIs(t, err, netpunchlib.ErrPeerUnreachable)
+	punchErr := (*netpunchlib.PunchError)(nil)
+	require.ErrorAs(t, err, &punchErr)
+	assert.Equal(t, netpunchlib.PhasePinging, punchErr.Phase)
+}
+
+func TestClient_timeout(t *testing.T) {
+	srv := fakeServer(t, []byte("nothing useful"))
+	start := time.Now()
+	_, _, err := netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", srv, netpunchlib.TimeoutOption(200*time.Millisecond))
+	require.ErrorIs(t, err, netpunchlib.ErrTimeout)
+	assert.False(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.EqualError(t, err, "timeout (phase reached: discovery)")
+}
+
+func TestClientConn(t *testing.T) {
+	for port, opts := range map[int][]netpunchlib.Option{ // port: different ports for different subtests
+		10500: {opt("peer")},
+		10510: {opt("peer"), netpunchlib.ConnOption(netpunchlib.SigningMiddleware([]byte("x"))), netpunchlib.KeepMiddlewareOption()},
+		10520: {
+			opt("peer"),
+			netpunchlib.ConnOption(netpunchlib.SigningMiddleware([]byte("x")), netpunchlib.ReplayProtectionMiddleware(time.Second, 0)),
+			netpunchlib.KeepMiddlewareOption(),
+		},
+		10530: {
+			opt("peer"),
+			netpunchlib.ConnOption(netpunchlib.EncryptionMiddleware([]byte("x")), netpunchlib.ReplayProtectionMiddleware(time.Second, 0)),
+			netpunchlib.KeepMiddlewareOption(),
+		},
+	} {
+		t.Run(strconv.Itoa(port), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ctrlAddr := fmt.Sprintf("127.0.0.1:%d", port)
+			go func() {
+				_ = netpunchlib.Server(ctx, ctrlAddr, append(opts, opt("server"))...)
+			}()
+
+			type result struct {
+				conn net.PacketConn
+				addr *net.UDPAddr
+				err  error
+			}
+			done := make(chan result, 2)
+			for i, role := range []string{"a", "b"} {
+				go func() {
+					conn, path, err := netpunchlib.ClientConn(ctx, role, fmt.Sprintf("127.0.0.1:%d", port+1+i), ctrlAddr, opts...)
+					if err != nil {
+						done <- result{err: err} //nolint:exhaustruct
+						return
+					}
+					done <- result{conn: conn, addr: path.RemoteAddr, err: nil}
+				}()
+			}
+			peers := [2]result{<-done, <-done}
+			for _, p := range peers {
+				require.NoError(t, p.err)
+				defer p.conn.Close()
+			}
+
+			if port != 10500 { // stray packets are rejected by middlewares and don't break reading
+				stray, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+				require.NoError(t, err)
+				_, err = stray.WriteTo([]byte("forged"), peers[1].conn.LocalAddr())
+				require.NoError(t, err)
+				require.NoError(t, stray.Close())
+			}
+
+			// socket is alive and ready to carry payload
+			_, err := peers[0].conn.WriteTo([]byte("hello"), peers[0].addr)
+			require.NoError(t, err)
+
+			buff := make([]byte, 1024)
+			for { // skip late handshake messages
+				require.NoError(t, peers[1].conn.SetReadDeadline(time.Now().Add(time.Second)))
+				n, addr, err := peers[1].conn.ReadFrom(buff)
+				require.NoError(t, err)
+				if string(buff[:n]) == "hello" {
+					assert.Equal(t, peers[0].conn.LocalAddr().String(), addr.String())
+					break
+				}
+				assert.True(t, strings.HasPrefix(string(buff[:n]), "z|"), string(buff[:n]))
+			}
+		})
+	}
+}
+
+func TestClient_peerIdentity(t *testing.T) {
+	for name, cs := range map[string]struct {
+		pong string
+		err  error
+	}{
+		"expected_peer":   {pong: "y|b|0123456789abcdef", err: nil},
+		"previous_run":    {pong: "y|b|fedcba9876543210", err: netpunchlib.ErrPeerUnreachable},
+		"stranger":        {pong: "y|d|0123456789abcdef", err: netpunchlib.ErrPeerUnreachable},
+		"legacy_message":  {pong: "y", err: netpunchlib.ErrPeerUnreachable},
+		"invalid_message": {pong: "y|b|0123456789abcdef|x", err: netpunchlib.ErrPeerUnreachable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			peer := fakeServer(t, []byte(cs.pong)) // it answers pong on every ping
+			srv := fakeServer(t, []byte("i|b|0123456789abcdef|0|"+peer))
+			_, addr, err := netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", srv, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...)
+			if cs.err != nil {
+				require.ErrorIs(t, err, cs.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, peer, addr.String())
+		})
+	}
+}
+
+func TestClient_controlNodes(t *testing.T) {
+	peer := fakeServer(t, []byte("y|b|0123456789abcdef"))
+	down := fakeServer(t, []byte("nothing useful"))
+	srv := fakeServer(t, []byte("i|b|0123456789abcdef|0|"+peer))
+	nodes := netpunchlib.ControlNodesOption("127.0.0.1:invalid-port", srv) // invalid node is skipped
+	_, addr, err := netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", down, append(fastSchedule(), netpunchlib.MaxCyclesOption(2), nodes)...)
+	require.NoError(t, err)
+	assert.Equal(t, peer, addr.String())
+
+	_, _, err = netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", "127.0.0.1:invalid-port", netpunchlib.ControlNodesOption("127.0.0.1:"))
+	require.Error(t, err) // nothing to talk to
+}
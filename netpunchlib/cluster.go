@@ -0,0 +1,111 @@
+package netpunchlib
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// resolveSiblings resolves sibling control nodes, see ClusterOption.
+func resolveSiblings(network string, siblings []string) ([]*net.UDPAddr, error) {
+	addrs := []*net.UDPAddr(nil)
+	for _, s := range siblings {
+		addr, err := net.ResolveUDPAddr(network, s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// sibling checks whether message comes from sibling control node.
+func (n *controlNode) sibling(addr *net.UDPAddr) bool {
+	for _, a := range n.siblings {
+		if a.IP.Equal(addr.IP) && a.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// replicate sends registration to siblings: s|name|nonce|age|addr4|addr6|local|predicted.
+// Relay requests are replicated as plain announces, relay lives on single control node.
+// Repeated announces are not replicated till half of TTL passes, it is enough to keep registration alive on siblings.
+func (n *controlNode) replicate(reg Registration, now time.Time) {
+	if len(n.siblings) == 0 {
+		return
+	}
+	flds := [][]byte{
+		{labelSync},
+		[]byte(reg.Name),
+		[]byte(reg.Nonce),
+		[]byte(reg.age(now)),
+		[]byte(reg.Addr4),
+		[]byte(reg.Addr6),
+		[]byte(reg.Local),
+		[]byte(reg.Predicted),
+	}
+	key := string(bytes.Join(append(flds[:3:3], flds[4:]...), []byte{labelsSeporator})) // age doesn't matter
+	if t, ok := n.replicated[key]; ok && now.Sub(t) < n.config.slotTTL/2 {
+		return
+	}
+	n.replicated[key] = now
+	_ = writeAll(n.conn, bytes.Join(flds, []byte{labelsSeporator}), n.siblings)
+}
+
+// forgetReplicated cleans up history of replication.
+func (n *controlNode) forgetReplicated(now time.Time) {
+	for m, t := range n.replicated {
+		if now.Sub(t) > n.config.slotTTL {
+			delete(n.replicated, m)
+		}
+	}
+}
+
+// sync registers peer, that is replicated by sibling. Siblings don't replicate it further,
+// so every control node has to list all others. Registration keeps its age, so it expires on all siblings at once.
+func (n *controlNode) sync(flds [][]byte) {
+	session, side, err := splitName(string(flds[1]))
+	if err != nil || !validNonce(string(flds[2])) {
+		return
+	}
+	age, err := strconv.Atoi(string(flds[3]))
+	if err != nil || age < 0 {
+		return
+	}
+	addr4, ok4 := syncAddr(string(flds[4]), true)
+	addr6, ok6 := syncAddr(string(flds[5]), false)
+	if !ok4 || !ok6 || addr4 == "" && addr6 == "" {
+		return
+	}
+	reg := Registration{ //nolint:exhaustruct
+		Session: session,
+		Side:    side,
+		Name:    string(flds[1]),
+		Nonce:   string(flds[2]),
+		Addr4:   addr4,
+		Addr6:   addr6,
+		Local:   sanitizeCandidates(string(flds[6]), maxLocalCandidates, privateAddr),
+		Seen:    time.Now().Add(-time.Duration(age) * time.Second),
+	}
+	reg.Predicted = sanitizeCandidates(string(flds[7]), maxPredictedPorts, sameIP(reg.ips()...))
+	err = n.peers.Register(reg)
+	if err == nil {
+		n.dirty = true
+	}
+}
+
+// syncAddr checks replicated address; it can be empty.
+func syncAddr(s string, ipv4 bool) (string, bool) {
+	if s == "" {
+		return "", true
+	}
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil || ap.Port() == 0 || ap.Addr().Unmap().Is4() != ipv4 {
+		return "", false
+	}
+	return s, true
+}
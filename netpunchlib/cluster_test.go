@@ -0,0 +1,96 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func clusterOption() netpunchlib.Option {
+	return netpunchlib.ControlConnOption(netpunchlib.SigningMiddleware([]byte("cluster")))
+}
+
+func startCluster(ctx context.Context, nodes ...string) {
+	for i, node := range nodes {
+		siblings := append(append([]string(nil), nodes[:i]...), nodes[i+1:]...)
+		go func() {
+			_ = netpunchlib.Server(ctx, node, opt("server "+node), clusterOption(), netpunchlib.ClusterOption(siblings...))
+		}()
+	}
+}
+
+func TestCluster_replication(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	nodes := []string{"127.0.0.1:11250", "127.0.0.1:11251"}
+	startCluster(ctx, nodes...)
+
+	peers := [2]*net.UDPConn{}
+	for i := range peers {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer conn.Close()
+		peers[i] = conn
+	}
+
+	// stranger can not inject registration
+	assert.Empty(t, ask(t, peers[1], nodes[0], "s|t:x|0123456789abcdef|0|127.0.0.1:1|||"))
+	assert.Empty(t, ask(t, peers[1], nodes[0], "n|t:y|fedcba9876543210"))
+
+	assert.Empty(t, ask(t, peers[0], nodes[1], "n|s:a|0123456789abcdef"))
+	time.Sleep(100 * time.Millisecond) // let it be replicated
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+peers[0].LocalAddr().String(), ask(t, peers[1], nodes[0], "n|s:b|fedcba9876543210"))
+	assert.Equal(t, "i|s:b|fedcba9876543210|0|"+peers[1].LocalAddr().String(), ask(t, peers[0], nodes[1], "n|s:a|0123456789abcdef"))
+}
+
+func TestCluster_punch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	nodes := []string{"127.0.0.1:11252", "127.0.0.1:11253", "127.0.0.1:11254"}
+	startCluster(ctx, nodes...)
+
+	done := make(chan error, 2)
+	for i, name := range []string{"a", "b"} {
+		go func() { // peers talk to different control nodes
+			_, _, err := netpunchlib.Client(ctx, name, fmt.Sprintf("127.0.0.1:%d", 11255+i), nodes[i*2], opt("peer "+name))
+			done <- err
+		}()
+	}
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+}
+
+func TestCluster_age(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	node := "127.0.0.1:11272"
+	go func() {
+		_ = netpunchlib.Server(ctx, node, opt("server"), clusterOption(), netpunchlib.ClusterOption("127.0.0.1:11273"))
+	}()
+
+	sibling, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11273}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer sibling.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer peer.Close()
+
+	// registration keeps its age, sibling doesn't make it younger
+	assert.Empty(t, askSigned(t, sibling, "cluster", node, "s|age:a|0123456789abcdef|30|127.0.0.1:1|||"))
+	assert.Equal(t, "i|age:a|0123456789abcdef|30|127.0.0.1:1", ask(t, peer, node, "n|age:b|fedcba9876543210"))
+}
+
+func TestCluster_controlConnRequired(t *testing.T) {
+	err := netpunchlib.Server(context.Background(), "127.0.0.1:0", netpunchlib.ClusterOption("127.0.0.1:1"))
+	require.EqualError(t, err, "cluster requires ControlConnOption: source address of sibling can be spoofed")
+}
@@ -0,0 +1,83 @@
+package netpunchlib
+
+import "net"
+
+const maxPacketSize = 4096
+
+// feeder is the bottom of middleware chain, that reads packets, that have already been read from socket.
+// It allows to pass the same packet through different chains.
+type feeder struct {
+	next    ConnectionWriter
+	message []byte
+	addr    *net.UDPAddr
+}
+
+func (f *feeder) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	return copy(b, f.message), f.addr, nil
+}
+
+func (f *feeder) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return f.next.WriteToUDP(b, addr)
+}
+
+func (f *feeder) Close() error {
+	return nil // socket is closed by owner of feeder
+}
+
+func chainOver(in *feeder, mw []ConnectionMiddleware) Connection { //nolint:ireturn
+	conn := Connection(in)
+	for _, m := range mw {
+		conn = m(conn)
+	}
+	return conn
+}
+
+// controlSplit passes messages exchanged with control nodes through their own chain of middlewares,
+// and all other messages through regular chain. See ControlConnOption.
+type controlSplit struct {
+	next    Connection
+	in      *feeder
+	control Connection
+	peer    Connection
+	addrs   []*net.UDPAddr // control nodes
+}
+
+func newControlSplit(next Connection, addrs []*net.UDPAddr, controlMW, peerMW []ConnectionMiddleware) *controlSplit {
+	in := &feeder{next: next, message: nil, addr: nil}
+	return &controlSplit{
+		next:    next,
+		in:      in,
+		control: chainOver(in, controlMW),
+		peer:    chainOver(in, peerMW),
+		addrs:   addrs,
+	}
+}
+
+func (s *controlSplit) chain(addr *net.UDPAddr) Connection { //nolint:ireturn
+	for _, a := range s.addrs {
+		if a.IP.Equal(addr.IP) && a.Port == addr.Port {
+			return s.control
+		}
+	}
+	return s.peer
+}
+
+func (s *controlSplit) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	buff := make([]byte, maxPacketSize)
+	n, addr, err := s.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	s.in.message, s.in.addr = buff[:n], addr // reading is sequential, so one feeder is enough
+	return s.chain(addr).ReadFromUDP(b)
+}
+
+func (s *controlSplit) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return s.chain(addr).WriteToUDP(b, addr)
+}
+
+func (s *controlSplit) Close() error {
+	_ = s.control.Close() // let middlewares know
+	_ = s.peer.Close()
+	return s.next.Close()
+}
@@ -0,0 +1,204 @@
+package netpunchlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const maxKnownAddrs = 4096
+
+// Credentials maps identities to individual secrets. Identity is session name (all sides of session share secret)
+// or peer name (secret of single peer).
+type Credentials struct {
+	identities []string
+	secrets    map[string][]byte
+}
+
+// ParseCredentials reads lines like "identity secret". Empty lines and lines starting with # are skipped.
+func ParseCredentials(r io.Reader) (*Credentials, error) {
+	creds := &Credentials{identities: nil, secrets: map[string][]byte{}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		identity, secret, _ := strings.Cut(s, " ")
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			return nil, fmt.Errorf("credentials: line %d: identity and secret expected", line)
+		}
+		if !validIdentity(identity) {
+			return nil, fmt.Errorf("credentials: line %d: invalid identity %q", line, identity)
+		}
+		if _, ok := creds.secrets[identity]; ok {
+			return nil, fmt.Errorf("credentials: line %d: duplicate identity %q", line, identity)
+		}
+		creds.identities = append(creds.identities, identity)
+		creds.secrets[identity] = []byte(secret)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(creds.identities) == 0 {
+		return nil, errors.New("credentials: no identities")
+	}
+	return creds, nil
+}
+
+// PublicKeys parses secrets of all identities as public keys (see PublicKeySigningMiddleware) and maps secrets to keys.
+// So middlewares of CredentialsMiddleware can take keys ready, they don't fail at runtime.
+func (c *Credentials) PublicKeys() (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey, len(c.identities))
+	for _, id := range c.identities {
+		key, err := ParsePublicKey(string(c.secrets[id]))
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %q: %w", id, err)
+		}
+		keys[string(c.secrets[id])] = key
+	}
+	return keys, nil
+}
+
+// LoadCredentials reads credentials file, see ParseCredentials.
+func LoadCredentials(fn string) (*Credentials, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCredentials(f)
+}
+
+func validIdentity(identity string) bool {
+	if _, _, err := splitName(identity); err == nil {
+		return true // peer name
+	}
+	if identity == "" || len(identity) > maxNameLen {
+		return false
+	}
+	for _, c := range []byte(identity) {
+		if !validNameChar(c) || c == nameSeparator {
+			return false
+		}
+	}
+	return true // session name
+}
+
+// allowed checks whether identity is allowed to use peer name.
+func allowed(identity, name string) bool {
+	session, _, err := splitName(name)
+	return err == nil && (identity == name || identity == session)
+}
+
+type credentialsWrapper struct {
+	next   Connection
+	in     *feeder
+	creds  *Credentials
+	chains map[string]Connection // identity -> chain
+	mx     sync.Mutex
+	known  map[string]string // address -> identity
+}
+
+// CredentialsMiddleware authenticates messages by individual secrets of peers; it is for control node.
+// Every secret gets its own chain of middlewares built by mw, e.g. SigningMiddleware or
+// ChainMiddleware(SigningMiddleware(secret), ReplayProtectionMiddleware(0, 0)).
+// Message is accepted if it passes one of chains, and announces are accepted only if the peer name
+// matches identity of the chain. Replies are sent through the chain of the peer.
+// So one peer can not take slots of other sessions and peers, and one secret can be revoked without re-keying everybody.
+func CredentialsMiddleware(creds *Credentials, mw func(secret []byte) ConnectionMiddleware) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		in := &feeder{next: conn, message: nil, addr: nil}
+		chains := make(map[string]Connection, len(creds.identities))
+		for _, id := range creds.identities {
+			chains[id] = mw(creds.secrets[id])(in)
+		}
+		return &credentialsWrapper{
+			next:   conn,
+			in:     in,
+			creds:  creds,
+			chains: chains,
+			mx:     sync.Mutex{},
+			known:  map[string]string{},
+		}
+	}
+}
+
+func (w *credentialsWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *credentialsWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	buff := make([]byte, maxPacketSize)
+	n, addr, err := w.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	w.in.message, w.in.addr = buff[:n], addr // reading is sequential, so one feeder is enough
+	for _, id := range w.candidates(addr) {
+		m, _, err := w.chains[id].ReadFromUDP(b)
+		if errors.Is(err, ErrRejected) {
+			continue // wrong secret
+		}
+		if err != nil {
+			return m, addr, err
+		}
+		if !w.authorized(id, b[:m]) {
+			return 0, addr, rejected("peer is not authorized: " + id)
+		}
+		w.remember(addr, id)
+		return m, addr, nil
+	}
+	return 0, addr, rejected("no matching credentials")
+}
+
+func (w *credentialsWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	w.mx.Lock()
+	id, ok := w.known[addr.String()]
+	w.mx.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no credentials for %s", addr)
+	}
+	return w.chains[id].WriteToUDP(b, addr)
+}
+
+// candidates returns identities to try; the last identity of address goes first.
+func (w *credentialsWrapper) candidates(addr *net.UDPAddr) []string {
+	w.mx.Lock()
+	id, ok := w.known[addr.String()]
+	w.mx.Unlock()
+	if !ok {
+		return w.creds.identities
+	}
+	return append([]string{id}, w.creds.identities...) // the second try is in vain, however it's harmless
+}
+
+func (w *credentialsWrapper) remember(addr *net.UDPAddr, id string) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if len(w.known) >= maxKnownAddrs {
+		w.known = map[string]string{} // it is cheaper than LRU, and peers are still able to retry
+	}
+	w.known[addr.String()] = id
+}
+
+// authorized checks that announces, relay requests, group joins and pairing confirmations come from peers,
+// they claim to be.
+func (w *credentialsWrapper) authorized(id string, message []byte) bool {
+	flds := bytes.Split(message, []byte{labelsSeporator})
+	if len(flds[0]) != 1 || !bytes.Contains([]byte{labelAnnounce, labelRelayReq, labelGroup, labelDone}, flds[0]) {
+		return true // other messages don't claim identity
+	}
+	return len(flds) >= 2 && allowed(id, string(flds[1]))
+}
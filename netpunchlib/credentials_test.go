@@ -0,0 +1,203 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestParseCredentials(t *testing.T) {
+	_, err := netpunchlib.ParseCredentials(strings.NewReader(`
+# sessions
+office-vpn  office secret
+ab the secret of session ab, legacy peers a and b have their own identities
+
+# peers
+home:left left-secret
+c c-secret
+`))
+	require.NoError(t, err)
+
+	for text, errMsg := range map[string]string{
+		"":                          "credentials: no identities",
+		"office":                    "credentials: line 1: identity and secret expected",
+		"a:b:c secret":              `credentials: line 1: invalid identity "a:b:c"`,
+		"in/valid secret":           `credentials: line 1: invalid identity "in/valid"`,
+		"office x\n\noffice y":      `credentials: line 3: duplicate identity "office"`,
+		"#office x\noffice\toffice": "credentials: line 2: identity and secret expected",
+	} {
+		t.Run(text, func(t *testing.T) {
+			_, err := netpunchlib.ParseCredentials(strings.NewReader(text))
+			require.EqualError(t, err, errMsg)
+		})
+	}
+}
+
+func TestCredentials_publicKeys(t *testing.T) {
+	_, pub, text := genKey(t)
+	creds, err := netpunchlib.ParseCredentials(strings.NewReader("keys:a " + text + "\n"))
+	require.NoError(t, err)
+	keys, err := creds.PublicKeys()
+	require.NoError(t, err)
+	assert.Equal(t, pub, keys[text])
+
+	creds, err = netpunchlib.ParseCredentials(strings.NewReader("keys:a " + text + "\nkeys:b secret\n"))
+	require.NoError(t, err)
+	_, err = creds.PublicKeys()
+	require.ErrorContains(t, err, `credentials: "keys:b": `)
+}
+
+func TestCredentials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	creds, err := netpunchlib.ParseCredentials(strings.NewReader("team team-secret\nhome:left left-secret\nhome:right right-secret\n"))
+	require.NoError(t, err)
+	sign := func(secret string) netpunchlib.ConnectionMiddleware {
+		return netpunchlib.SigningMiddleware([]byte(secret))
+	}
+
+	ctrlAddr := "127.0.0.1:11000"
+	secure := func(secret []byte) netpunchlib.ConnectionMiddleware {
+		return netpunchlib.ChainMiddleware(netpunchlib.SigningMiddleware(secret), netpunchlib.ReplayProtectionMiddleware(0, 0))
+	}
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"), netpunchlib.ConnOption(netpunchlib.CredentialsMiddleware(creds, secure)))
+	}()
+
+	type result struct {
+		path *netpunchlib.Path
+		err  error
+	}
+	punch := func(name string, port int, opts ...netpunchlib.Option) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			path, err := netpunchlib.ClientPath(ctx, name, fmt.Sprintf("127.0.0.1:%d", port), ctrlAddr, append(opts, opt(name))...)
+			done <- result{path: path, err: err}
+		}()
+		return done
+	}
+	replay := netpunchlib.ReplayProtectionMiddleware(0, 0)
+
+	t.Run("session_secret", func(t *testing.T) {
+		a := punch("team:a", 11001, netpunchlib.ConnOption(sign("team-secret"), replay))
+		b := punch("team:b", 11002, netpunchlib.ConnOption(sign("team-secret"), replay))
+		for _, done := range []<-chan result{a, b} {
+			r := <-done
+			require.NoError(t, r.err)
+		}
+	})
+
+	t.Run("peer_secrets", func(t *testing.T) {
+		peer := netpunchlib.ConnOption(sign("home-peers-secret"), replay) // secret of peers, control node doesn't know it
+		a := punch("home:left", 11003, peer, netpunchlib.ControlConnOption(sign("left-secret"), replay))
+		b := punch("home:right", 11004, peer, netpunchlib.ControlConnOption(sign("right-secret"), replay))
+		for _, done := range []<-chan result{a, b} {
+			r := <-done
+			require.NoError(t, r.err)
+		}
+	})
+
+	t.Run("stranger_secret", func(t *testing.T) {
+		// the right peer is trying to take slot of the left one
+		r := <-punch("home:left", 11005, append(fastSchedule(), netpunchlib.MaxCyclesOption(2),
+			netpunchlib.ConnOption(sign("right-secret"), replay))...)
+		require.ErrorIs(t, r.err, netpunchlib.ErrServerUnreachable)
+	})
+}
+
+func TestControlConnOption_probe(t *testing.T) {
+	// all probe messages go to control nodes, so they are signed by control secret
+	servers := []string(nil)
+	for range 2 {
+		srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer srv.Close()
+		conn := netpunchlib.SigningMiddleware([]byte("control"))(srv)
+		go func() {
+			buff := make([]byte, 1024)
+			for {
+				n, addr, err := conn.ReadFromUDP(buff)
+				if err != nil {
+					return
+				}
+				if string(buff[:n]) == "p" {
+					_, _ = conn.WriteToUDP([]byte("o|"+addr.String()), addr)
+				}
+			}
+		}()
+		servers = append(servers, srv.LocalAddr().String())
+	}
+	res, err := netpunchlib.Probe(context.Background(), "127.0.0.1:0", servers, append(fastSchedule(),
+		netpunchlib.ConnOption(netpunchlib.SigningMiddleware([]byte("peer"))),
+		netpunchlib.ControlConnOption(netpunchlib.SigningMiddleware([]byte("control"))))...)
+	require.NoError(t, err)
+	assert.Equal(t, netpunchlib.NATNone, res.Type)
+}
+
+// askSigned is like ask, however message is signed by secret.
+func askSigned(t *testing.T, conn *net.UDPConn, secret, srv, message string) string {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", srv)
+	require.NoError(t, err)
+	signed := netpunchlib.SigningMiddleware([]byte(secret))(conn)
+	buff := make([]byte, 1024)
+	for range 10 { // server can be not ready yet
+		_, err = signed.WriteToUDP([]byte(message), addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		n, _, err := signed.ReadFromUDP(buff)
+		if err == nil {
+			return string(buff[:n])
+		}
+	}
+	return ""
+}
+
+func TestCredentials_claims(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	creds, err := netpunchlib.ParseCredentials(strings.NewReader(`
+home:left left-secret
+home:right right-secret
+crew:a a-secret
+crew:b b-secret
+crew:c c-secret
+`))
+	require.NoError(t, err)
+
+	srv := "127.0.0.1:11270"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.ConsumeOnceOption(),
+			netpunchlib.ConnOption(netpunchlib.CredentialsMiddleware(creds, netpunchlib.SigningMiddleware)))
+	}()
+
+	conns := [3]*net.UDPConn{}
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	t.Run("done", func(t *testing.T) {
+		assert.Empty(t, askSigned(t, conns[0], "left-secret", srv, "n|home:left|0123456789abcdef"))
+		assert.Empty(t, askSigned(t, conns[1], "right-secret", srv, "d|home:left|0123456789abcdef")) // the right peer is trying to consume the left one
+		assert.Equal(t, "i|home:left|0123456789abcdef|0|"+conns[0].LocalAddr().String(), askSigned(t, conns[1], "right-secret", srv, "n|home:right|fedcba9876543210"))
+	})
+
+	t.Run("group", func(t *testing.T) {
+		assert.Empty(t, askSigned(t, conns[1], "b-secret", srv, "g|crew:b|fedcba9876543210|3"))
+		assert.Empty(t, askSigned(t, conns[1], "b-secret", srv, "g|crew:a|0123456789abcdef|3")) // b is trying to join as a
+		assert.Equal(t, "m|crew:b|fedcba9876543210|0|"+conns[1].LocalAddr().String()+"|", askSigned(t, conns[2], "c-secret", srv, "g|crew:c|0011223344556677|3"))
+	})
+}
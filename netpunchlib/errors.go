@@ -0,0 +1,39 @@
+package netpunchlib
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrServerUnreachable means we haven't got any information about peer: server is down, or peer hasn't come.
+	ErrServerUnreachable = errors.New("server unreachable")
+	// ErrPeerUnreachable means we have got peer address, however punching failed.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	// ErrTimeout means the deadline (see TimeoutOption) has been reached.
+	ErrTimeout = errors.New("timeout")
+	// ErrPeerGone means peer's keepalives stopped.
+	ErrPeerGone = errors.New("peer gone")
+	// ErrRejected means middleware has dropped incoming packet: invalid signature, replay and so on.
+	// It is not fatal, reading can be continued. Error wraps ErrRejected and tells the reason.
+	ErrRejected = errors.New("message rejected")
+)
+
+func rejected(reason string) error {
+	return fmt.Errorf("%w: %s", ErrRejected, reason)
+}
+
+// PunchError is returned by Client when it gives up.
+// Phase is the most advanced phase of FSM that has been reached.
+type PunchError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *PunchError) Error() string {
+	return fmt.Sprintf("%s (phase reached: %s)", e.Err.Error(), e.Phase)
+}
+
+func (e *PunchError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,305 @@
+package netpunchlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxGroupSize      = 10
+	maxMembersPayload = 3 * 1024 // room for signatures, timestamps and so on
+	memberFields      = 5        // name|nonce|age|addrs|local
+)
+
+// groupMember is punching to single member of group; it is driven by its own processor.
+type groupMember struct {
+	dataChan chan receivedMessage
+}
+
+type memberResult struct {
+	name string
+	path *Path
+	err  error
+}
+
+// ClientGroup punches holes to all other members of group session at the same time through single socket.
+// Members are named like peers of named sessions (session:side); control node tells every member
+// about all others. ClientGroup returns as soon as holes to size-1 other members are punched:
+// it returns map from peer name to its address.
+// Group consists of 2 to 10 members. Relay and port prediction are not supported in groups.
+func ClientGroup(ctx context.Context, name, address, remoteAddress string, size int, opt ...Option) (map[string]*net.UDPAddr, error) {
+	if size < 2 || size > maxGroupSize {
+		return nil, fmt.Errorf("invalid group size: %d: from 2 to %d expected", size, maxGroupSize)
+	}
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 1 {
+		return nil, fmt.Errorf("invalid group member name: %q: it has to look like session:side", name)
+	}
+
+	config := newConfig(opt...)
+	err = checkNetwork(config.network)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr(config.network, address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolveServers(ctx, config, laddr, remoteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP(config.network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	local := []string(nil)
+	if config.local {
+		local = localCandidates(config.network, laddr, udpConn.LocalAddr().(*net.UDPAddr).Port) //nolint:forcetypeassert
+	}
+	self := peerIdentity{name: name, nonce: newNonce()}
+	conn := config.wrapClientConnection(udpConn, addrs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()         // we must to cancel first
+		_ = conn.Close() // will be closed synchronously; it stops processors as well
+	}()
+
+	serverDataChan := make(chan receivedMessage)
+	serverErrChan := make(chan error)
+
+	go serve(ctx, conn, serverDataChan, serverErrChan)
+
+	return dispatch(conn, config, laddr, addrs, self, buildGroupMessage(self, size, local), size-1, serverDataChan, serverErrChan)
+}
+
+// dispatch announces member until all other members are known, runs processor for every member
+// and routes messages to them.
+func dispatch(
+	conn ConnectionWriter,
+	config *Config,
+	laddr *net.UDPAddr,
+	serverAddrs []*net.UDPAddr,
+	self peerIdentity,
+	groupMessage []byte,
+	expected int,
+	serverDataChan <-chan receivedMessage,
+	serverErrChan <-chan error,
+) (map[string]*net.UDPAddr, error) {
+	var deadline <-chan time.Time // nil channel blocks forever
+	if config.timeout > 0 {
+		timer := time.NewTimer(config.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	d := &groupDispatcher{
+		conn:         conn,
+		config:       config,
+		laddr:        laddr,
+		serverAddrs:  serverAddrs,
+		self:         self,
+		groupMessage: groupMessage,
+		expected:     expected,
+		members:      map[string]*groupMember{},
+		results:      make(chan memberResult, expected), // processors must not hang
+		mode:         PhaseDiscovering,
+		cycles:       1,
+		tryCount:     0,
+	}
+	peers := map[string]*net.UDPAddr{}
+	var retry <-chan time.Time // nil means we have to (re)send announce
+	for {
+		if retry == nil && len(d.members) < expected {
+			err := d.send()
+			if err != nil {
+				return nil, err
+			}
+			retry = time.After(config.schedule[d.mode].delay(d.tryCount))
+		}
+		select {
+		case <-retry:
+			retry = nil
+			err := d.onRetry()
+			if err != nil {
+				return nil, err
+			}
+		case data := <-serverDataChan:
+			if d.onMessage(data) {
+				retry = nil
+			}
+		case r := <-d.results:
+			if r.err != nil {
+				return nil, fmt.Errorf("%s: %w", r.name, r.err)
+			}
+			peers[r.name] = r.path.RemoteAddr
+			if len(peers) == expected {
+				return peers, nil
+			}
+		case err := <-serverErrChan:
+			return nil, err
+		case <-deadline:
+			return nil, &PunchError{Phase: PhaseDiscovering, Err: ErrTimeout}
+		}
+	}
+}
+
+// groupDispatcher is state of dispatch.
+type groupDispatcher struct {
+	conn         ConnectionWriter
+	config       *Config
+	laddr        *net.UDPAddr
+	serverAddrs  []*net.UDPAddr
+	self         peerIdentity
+	groupMessage []byte
+	expected     int
+	members      map[string]*groupMember
+	results      chan memberResult
+	mode         Phase // discovering or sleeping
+	cycles       int
+	tryCount     int
+}
+
+func (d *groupDispatcher) send() error {
+	d.tryCount++
+	if d.mode != PhaseDiscovering {
+		return nil
+	}
+	return writeAll(d.conn, d.groupMessage, d.serverAddrs)
+}
+
+// onRetry performs transition if count of tries exhausted; it returns error if dispatcher gives up.
+func (d *groupDispatcher) onRetry() error {
+	if d.tryCount < d.config.schedule[d.mode].retries() {
+		return nil
+	}
+	d.tryCount = 0
+	if d.mode == PhaseSleeping {
+		d.mode = PhaseDiscovering
+		d.cycles++
+		return nil
+	}
+	if d.config.maxCycles > 0 && d.cycles >= d.config.maxCycles {
+		if len(d.members) > 0 { // control node answers, however some members don't come
+			return &PunchError{Phase: PhaseDiscovering, Err: ErrPeerUnreachable}
+		}
+		return &PunchError{Phase: PhaseDiscovering, Err: ErrServerUnreachable}
+	}
+	d.mode = PhaseSleeping
+	return nil
+}
+
+// onMessage routes message to processor of member; it reports whether announce has to be sent right now.
+func (d *groupDispatcher) onMessage(data receivedMessage) bool {
+	if len(data.message) == 0 {
+		return false
+	}
+	flds := bytes.Split(data.message, []byte{labelsSeporator})
+	if data.message[0] == labelMembers {
+		d.onMembers(data.addr, flds)
+		return false
+	}
+	if bytes.IndexByte(handshakeLabels, data.message[0]) < 0 || len(flds) != 3 {
+		return false // ignore invalid messages
+	}
+	if m, ok := d.members[string(flds[1])]; ok {
+		m.feed(data)
+		return false
+	}
+	if d.mode == PhaseSleeping && len(d.members) < d.expected { // unknown member knows about us: ask server right now
+		d.mode = PhaseDiscovering
+		d.tryCount = 0
+		return true
+	}
+	return false
+}
+
+// onMembers starts processors of new members and passes peer info to all of them.
+func (d *groupDispatcher) onMembers(addr *net.UDPAddr, flds [][]byte) {
+	for _, info := range parseMembers(d.self, flds) {
+		name := string(info[1])
+		m, ok := d.members[name]
+		if !ok {
+			if len(d.members) >= d.expected {
+				continue // group is full
+			}
+			m = startMember(d.conn, d.config, d.laddr, d.serverAddrs, d.self, d.groupMessage, name, d.results)
+			d.members[name] = m
+		}
+		m.feed(receivedMessage{message: bytes.Join(info, []byte{labelsSeporator}), addr: addr})
+	}
+}
+
+// parseMembers converts members message to peer info messages: i|name|nonce|age|addrs|local.
+func parseMembers(self peerIdentity, flds [][]byte) [][][]byte {
+	if len(flds) < 1+memberFields || (len(flds)-1)%memberFields != 0 {
+		return nil
+	}
+	infos := [][][]byte(nil)
+	for i := 1; i < len(flds); i += memberFields {
+		m := flds[i : i+memberFields]
+		if string(m[0]) == self.name || checkName(string(m[0])) != nil || !validNonce(string(m[1])) {
+			continue
+		}
+		if age, err := strconv.Atoi(string(m[2])); err != nil || age < 0 {
+			continue
+		}
+		infos = append(infos, append([][]byte{{labelPeerInfo}}, m...))
+	}
+	return infos
+}
+
+func startMember(
+	conn ConnectionWriter,
+	config *Config,
+	laddr *net.UDPAddr,
+	serverAddrs []*net.UDPAddr,
+	self peerIdentity,
+	groupMessage []byte,
+	name string,
+	results chan<- memberResult,
+) *groupMember {
+	m := &groupMember{dataChan: make(chan receivedMessage, 16)}
+	pathChan := make(chan *Path, 1)
+	errChan := make(chan error, 1)
+	// processor announces itself by group message when it starts new cycle, so it gets fresh addresses too;
+	// it never confirms pairing, the other members are still waiting for us
+	go processor(conn, config, laddr, serverAddrs, self, groupMessage, nil, nil, m.dataChan, make(chan error), config.deadline(), pathChan, errChan)
+	go func() {
+		select {
+		case path := <-pathChan:
+			results <- memberResult{name: name, path: path, err: nil}
+		case err := <-errChan:
+			results <- memberResult{name: name, path: nil, err: err}
+		}
+	}()
+	return m
+}
+
+// feed never blocks: messages to finished processors are dropped, as well as excess messages.
+func (m *groupMember) feed(data receivedMessage) {
+	select {
+	case m.dataChan <- data:
+	default:
+	}
+}
+
+// buildGroupMessage builds g|name|nonce|size|local; control node doesn't let more members join the group.
+func buildGroupMessage(self peerIdentity, size int, local []string) []byte {
+	m := self.message(labelGroup)
+	m = append(m, labelsSeporator)
+	m = strconv.AppendInt(m, int64(size), 10)
+	if len(local) > 0 {
+		m = append(m, labelsSeporator)
+		m = append(m, strings.Join(local, string(addrsSeparator))...)
+	}
+	return m
+}
@@ -0,0 +1,104 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestClientGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlAddr := "127.0.0.1:11220"
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"))
+	}()
+
+	type result struct {
+		name  string
+		peers map[string]*net.UDPAddr
+		err   error
+	}
+	sides := []string{"left", "right", "center", "top"}
+	done := make(chan result, len(sides))
+	for i, side := range sides {
+		name := "mesh:" + side
+		go func() {
+			peers, err := netpunchlib.ClientGroup(ctx, name, fmt.Sprintf("127.0.0.1:%d", 11221+i), ctrlAddr, len(sides), opt(name))
+			done <- result{name: name, peers: peers, err: err}
+		}()
+	}
+	for range sides {
+		r := <-done
+		require.NoError(t, r.err, r.name)
+		require.Len(t, r.peers, len(sides)-1)
+		for i, side := range sides {
+			name := "mesh:" + side
+			if name == r.name {
+				assert.NotContains(t, r.peers, name)
+				continue
+			}
+			require.Contains(t, r.peers, name)
+			assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", 11221+i), r.peers[name].String())
+		}
+	}
+}
+
+func TestClientGroup_invalid(t *testing.T) {
+	for name, cs := range map[string]struct {
+		name string
+		size int
+		err  string
+	}{
+		"too_small":   {name: "s:a", size: 1, err: "invalid group size: 1: from 2 to 10 expected"},
+		"too_big":     {name: "s:a", size: 11, err: "invalid group size: 11: from 2 to 10 expected"},
+		"legacy_name": {name: "a", size: 3, err: `invalid group member name: "a": it has to look like session:side`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := netpunchlib.ClientGroup(context.Background(), cs.name, "127.0.0.1:0", "127.0.0.1:1", cs.size)
+			require.EqualError(t, err, cs.err)
+		})
+	}
+}
+
+func TestClientGroup_maxCycles(t *testing.T) {
+	srv := fakeServer(t, []byte("m|mesh:b|0123456789abcdef|0|127.0.0.1:1|")) // the only member of three
+	_, err := netpunchlib.ClientGroup(context.Background(), "mesh:a", "127.0.0.1:0", srv, 3, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...)
+	require.ErrorIs(t, err, netpunchlib.ErrPeerUnreachable)
+
+	srv = fakeServer(t, []byte("nothing useful"))
+	_, err = netpunchlib.ClientGroup(context.Background(), "mesh:a", "127.0.0.1:0", srv, 3, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...)
+	require.ErrorIs(t, err, netpunchlib.ErrServerUnreachable)
+}
+
+func TestServer_groupSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11271"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"))
+	}()
+
+	conns := [3]*net.UDPConn{}
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	assert.Empty(t, ask(t, conns[0], srv, "g|duo:a|0123456789abcdef|2"))
+	assert.Equal(t, "m|duo:a|0123456789abcdef|0|"+conns[0].LocalAddr().String()+"|", ask(t, conns[1], srv, "g|duo:b|fedcba9876543210|2"))
+	assert.Empty(t, ask(t, conns[2], srv, "g|duo:c|0011223344556677|2")) // group is full
+	assert.Equal(t, "m|duo:b|fedcba9876543210|0|"+conns[1].LocalAddr().String()+"|", ask(t, conns[0], srv, "g|duo:a|0123456789abcdef|2"))
+	assert.Empty(t, ask(t, conns[0], srv, "g|duo:a|0123456789abcdef|11")) // invalid size
+}
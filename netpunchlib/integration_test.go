@@ -95,6 +95,108 @@ LOOP:
 	}
 }
 
+func TestNamedSessions(t *testing.T) {
+	host := "127.0.0.1"
+	ctrlAddr := host + ":10100"
+	peers := map[string]string{ // name -> address
+		"office-vpn:left":  host + ":10101",
+		"office-vpn:right": host + ":10102",
+		"backup:one":       host + ":10103",
+		"backup:two":       host + ":10104",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlDone := make(chan error, 1)
+	go func() {
+		ctrlDone <- netpunchlib.Server(ctx, ctrlAddr, opt("server"))
+	}()
+
+	type result struct {
+		name string
+		b    *net.UDPAddr
+		err  error
+	}
+	peerDone := make(chan result, len(peers))
+	for name, addr := range peers {
+		go func() {
+			_, b, err := netpunchlib.Client(ctx, name, addr, ctrlAddr, opt("peer "+name))
+			peerDone <- result{name: name, b: b, err: err}
+		}()
+	}
+
+	opposite := map[string]string{
+		"office-vpn:left":  "office-vpn:right",
+		"office-vpn:right": "office-vpn:left",
+		"backup:one":       "backup:two",
+		"backup:two":       "backup:one",
+	}
+	for range peers {
+		res := <-peerDone
+		require.NoError(t, res.err, res.name)
+		assert.Equal(t, peers[opposite[res.name]], res.b.String(), res.name)
+	}
+
+	cancel()
+	require.ErrorIs(t, <-ctrlDone, context.Canceled)
+}
+
+func TestSchedule(t *testing.T) {
+	// Peer a exhausts discovery and falls asleep before peer b starts.
+	// It has to wake up quickly due to short sleep phase, default 30s sleep would break the test
+	host := "127.0.0.1"
+	ctrlAddr := host + ":10200"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"))
+	}()
+
+	schedule := []netpunchlib.Option{
+		opt("peer"),
+		netpunchlib.ScheduleOption(netpunchlib.PhaseDiscovering, netpunchlib.Backoff{ //nolint:exhaustruct
+			Retries: 3,
+			Delay:   10 * time.Millisecond,
+		}),
+		netpunchlib.ScheduleOption(netpunchlib.PhaseSleeping, netpunchlib.Backoff{ //nolint:exhaustruct
+			Retries: 1,
+			Delay:   50 * time.Millisecond,
+			Jitter:  0.5,
+		}),
+		netpunchlib.ScheduleOption(netpunchlib.PhasePinging, netpunchlib.Backoff{
+			Retries:    5,
+			Delay:      10 * time.Millisecond,
+			MaxDelay:   50 * time.Millisecond,
+			Multiplier: 2,
+			Jitter:     0,
+		}),
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, _, err := netpunchlib.Client(ctx, "late:a", host+":10201", ctrlAddr, schedule...)
+		errs <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+	go func() {
+		_, _, err := netpunchlib.Client(ctx, "late:b", host+":10202", ctrlAddr, schedule...)
+		errs <- err
+	}()
+
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+}
+
+func TestInvalidName(t *testing.T) {
+	for _, name := range []string{"", "A", "ab", "session", ":side", "session:", "a:b:c", "a|b:c", "a b:c"} {
+		_, _, err := netpunchlib.Client(context.Background(), name, "127.0.0.1:0", "127.0.0.1:1")
+		require.Error(t, err, name)
+	}
+}
+
 func opt(p string) netpunchlib.Option {
 	return netpunchlib.ConnOption(netpunchlib.LoggingMiddleware(log.New(os.Stderr, "["+p+"] ", 0)))
 }
@@ -0,0 +1,111 @@
+package netpunchlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Keepalive keeps NAT mapping alive after punching: it sends keepalive messages to peer every interval
+// until handoff is closed. It returns ErrPeerGone if peer's keepalives don't come during timeout.
+// Connection have to be obtained by ClientConn; use KeepMiddlewareOption to sign keepalives.
+// Connection is not closed, it is ready to be reused or closed by caller.
+// Interval has to be positive and timeout has to be longer than interval.
+func Keepalive(ctx context.Context, conn net.PacketConn, peer *net.UDPAddr, interval, timeout time.Duration, handoff <-chan struct{}) error {
+	err := checkKeepalive(interval, timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	aliveChan := make(chan struct{})
+	errChan := make(chan error)
+	readDone := make(chan struct{})
+
+	go func() {
+		defer close(readDone)
+		keepaliveReader(ctx, conn, peer, aliveChan, errChan)
+	}()
+	defer func() {
+		cancel() // we must to cancel first
+		if conn.SetReadDeadline(time.Now()) == nil {
+			<-readDone
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	watchdog := time.NewTimer(timeout)
+	defer watchdog.Stop()
+
+	message := []byte{labelKeepalive}
+	_, err = conn.WriteTo(message, peer)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ticker.C:
+			_, err = conn.WriteTo(message, peer)
+			if err != nil {
+				return err
+			}
+		case <-aliveChan:
+			watchdog.Reset(timeout)
+		case <-watchdog.C:
+			return ErrPeerGone
+		case err := <-errChan:
+			return err
+		case <-handoff:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func checkKeepalive(interval, timeout time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid keepalive interval: %s: it has to be positive", interval)
+	}
+	if timeout <= interval {
+		return fmt.Errorf("invalid keepalive timeout: %s: it has to be longer than interval %s", timeout, interval)
+	}
+	return nil
+}
+
+func keepaliveReader(ctx context.Context, conn net.PacketConn, peer *net.UDPAddr, aliveChan chan<- struct{}, errChan chan<- error) {
+	buff := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrRejected) {
+			continue
+		}
+		if err != nil {
+			select {
+			case errChan <- err:
+			case <-ctx.Done():
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !udpAddr.IP.Equal(peer.IP) || udpAddr.Port != peer.Port {
+			continue
+		}
+		if n != 1 || buff[0] != labelKeepalive {
+			continue // it can be late handshake message
+		}
+		select {
+		case aliveChan <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestKeepalive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlAddr := "127.0.0.1:10600"
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"))
+	}()
+
+	handoff := make(chan struct{})
+	start := time.Now()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		close(handoff)
+	}()
+
+	errs := make(chan error, 2)
+	for i, role := range []string{"a", "b"} {
+		go func() {
+			_, _, err := netpunchlib.Client(ctx, role, fmt.Sprintf("127.0.0.1:%d", 10601+i), ctrlAddr,
+				opt("peer "+role), netpunchlib.KeepaliveOption(20*time.Millisecond, 200*time.Millisecond, handoff))
+			errs <- err
+		}()
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestKeepalive_peerGone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlAddr := "127.0.0.1:10610"
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"))
+	}()
+
+	type result struct {
+		conn net.PacketConn
+		addr *net.UDPAddr
+		err  error
+	}
+	done := make(chan result, 2)
+	for i, role := range []string{"a", "b"} {
+		go func() {
+			conn, path, err := netpunchlib.ClientConn(ctx, role, fmt.Sprintf("127.0.0.1:%d", 10611+i), ctrlAddr, opt("peer "+role))
+			if err != nil {
+				done <- result{err: err} //nolint:exhaustruct
+				return
+			}
+			done <- result{conn: conn, addr: path.RemoteAddr, err: nil}
+		}()
+	}
+	peers := [2]result{<-done, <-done}
+	for _, p := range peers {
+		require.NoError(t, p.err)
+	}
+	defer peers[0].conn.Close()
+	require.NoError(t, peers[1].conn.Close()) // peer is gone right away
+
+	err := netpunchlib.Keepalive(ctx, peers[0].conn, peers[0].addr, 20*time.Millisecond, 200*time.Millisecond, nil)
+	require.ErrorIs(t, err, netpunchlib.ErrPeerGone)
+
+	// socket is still usable after keepalive
+	_, err = peers[0].conn.WriteTo([]byte("x"), peers[0].addr)
+	require.NoError(t, err)
+}
+
+func TestKeepalive_invalid(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	peer := conn.LocalAddr().(*net.UDPAddr) //nolint:forcetypeassert
+
+	for _, cs := range [][2]time.Duration{{0, time.Second}, {-time.Second, time.Second}, {time.Second, 0}, {time.Second, time.Second}} {
+		err := netpunchlib.Keepalive(context.Background(), conn, peer, cs[0], cs[1], nil)
+		require.Error(t, err, cs)
+	}
+
+	// client doesn't even try to punch
+	_, _, err = netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", "127.0.0.1:1", netpunchlib.KeepaliveOption(0, time.Second, nil))
+	require.EqualError(t, err, "invalid keepalive interval: 0s: it has to be positive")
+}
@@ -1,9 +1,19 @@
 package netpunchlib
 
 const (
+	labelAnnounce   = 'n'
 	labelPeerInfo   = 'i'
 	labelPing       = 'x'
 	labelPong       = 'y'
 	labelClose      = 'z'
+	labelKeepalive  = 'k'
+	labelRelayReq   = 'r'
+	labelRelayInfo  = 'l'
+	labelProbe      = 'p'
+	labelObserved   = 'o'
+	labelDone       = 'd'
+	labelGroup      = 'g'
+	labelMembers    = 'm'
+	labelSync       = 's'
 	labelsSeporator = '|'
 )
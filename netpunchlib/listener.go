@@ -2,6 +2,7 @@ package netpunchlib
 
 import (
 	"context"
+	"errors"
 	"net"
 )
 
@@ -14,22 +15,32 @@ func serve(ctx context.Context, conn ConnectionReader, serverDataChan chan<- rec
 	// You are to manage this function gently
 	// To avoid hanging and panics keep in mind:
 	// - it is bad idea to close args channels
-	// - you have to cancel context before closing connection
+	// - you have to cancel context before closing connection (or interrupting reading by deadline)
 	// It's not unforgivable if we do it in private helper function, however
 	// you might think twice before you borrow this code
 	for {
-		buff := make([]byte, 1024)
+		buff := make([]byte, maxPacketSize)    // list of group members can be long
 		n, addr, err := conn.ReadFromUDP(buff) // will be interrupted by closing connection
 		if ctx.Err() != nil {                  // we must *not* use channels after canceling
 			return
 		}
+		if errors.Is(err, ErrRejected) {
+			continue // middleware has dropped the packet, it is not fatal
+		}
 		if err != nil {
-			serverErrChan <- err
+			select {
+			case serverErrChan <- err:
+			case <-ctx.Done(): // nobody is waiting for error anymore
+			}
 			return
 		}
-		serverDataChan <- receivedMessage{
+		select {
+		case serverDataChan <- receivedMessage{
 			message: buff[:n],
 			addr:    addr,
+		}:
+		case <-ctx.Done(): // nobody is waiting for data anymore
+			return
 		}
 	}
 }
@@ -0,0 +1,76 @@
+package netpunchlib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+)
+
+const encryptionKeyLabel = "netpunch encryption key v1"
+
+type cryptWrapper struct {
+	next Connection
+	aead cipher.AEAD
+}
+
+// EncryptionMiddleware encrypts and authenticates messages by AES-256-GCM with key derived from shared secret.
+// It hides peers' addresses from anyone watching the path, and it can be used instead of SigningMiddleware.
+// Message looks like nonce|ciphertext|tag, nonce is random.
+func EncryptionMiddleware(secret []byte) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		return &cryptWrapper{
+			next: conn,
+			aead: newAEAD(secret),
+		}
+	}
+}
+
+func newAEAD(secret []byte) cipher.AEAD { //nolint:ireturn
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(encryptionKeyLabel)) // hash never returns an error
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err) // impossible: key is always 32 bytes long
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err) // impossible: standard nonce and tag sizes
+	}
+	return aead
+}
+
+func (w *cryptWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *cryptWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	ns := w.aead.NonceSize()
+	buff := make([]byte, len(b)+ns+w.aead.Overhead())
+	n, addr, err := w.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	if n < ns+w.aead.Overhead() {
+		return 0, addr, rejected("too short")
+	}
+	data, err := w.aead.Open(buff[ns:ns], buff[:ns], buff[ns:n], nil)
+	if err != nil {
+		return 0, addr, rejected("can not be decrypted")
+	}
+	return copy(b, data), addr, nil
+}
+
+func (w *cryptWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	ns := w.aead.NonceSize()
+	buff := make([]byte, ns, ns+len(b)+w.aead.Overhead())
+	_, _ = rand.Read(buff) // it never returns an error
+	buff = w.aead.Seal(buff, buff, b, nil)
+	_, err := w.next.WriteToUDP(buff, addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil // pretend we wrote given data
+}
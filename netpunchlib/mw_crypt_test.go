@@ -0,0 +1,39 @@
+package netpunchlib_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestEncryption_ok(t *testing.T) {
+	m, queue := loopbackMock(t)
+	conn := netpunchlib.EncryptionMiddleware([]byte("MORN"))(m)
+
+	n, err := conn.WriteToUDP([]byte("i|a|0123456789abcdef|1.2.3.4:5"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 30, n)
+	require.Len(t, *queue, 1)
+	assert.Len(t, (*queue)[0], 12+30+16) // nonce, data and tag
+	assert.NotContains(t, string((*queue)[0]), "1.2.3.4")
+
+	assert.Equal(t, "i|a|0123456789abcdef|1.2.3.4:5", readString(t, conn))
+}
+
+func TestEncryption_invalid(t *testing.T) {
+	m, queue := loopbackMock(t)
+	_, err := netpunchlib.EncryptionMiddleware([]byte("ALIEN"))(m).WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	conn := netpunchlib.EncryptionMiddleware([]byte("MORN"))(m)
+	_, err = conn.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	(*queue)[1][20] ^= 1 // tampered
+	*queue = append(*queue, []byte("short"))
+
+	assert.Equal(t, "message rejected: can not be decrypted", readErr(t, conn))
+	assert.Equal(t, "message rejected: can not be decrypted", readErr(t, conn))
+	assert.Equal(t, "message rejected: too short", readErr(t, conn))
+}
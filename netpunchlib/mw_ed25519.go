@@ -0,0 +1,142 @@
+package netpunchlib
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	publicKeyPrefix  = "ed25519:"
+	privateKeyPrefix = "ed25519-private:"
+)
+
+var edSignLen = base64.StdEncoding.EncodedLen(ed25519.SignatureSize) //nolint:gochecknoglobals // base64 has fixed length, unlike ascii85
+
+type edSignWrapper struct {
+	next    Connection
+	key     ed25519.PrivateKey
+	trusted []ed25519.PublicKey
+}
+
+// PublicKeySigningMiddleware is alternative to SigningMiddleware: it signs messages by Ed25519 private key
+// and accepts messages signed by one of trusted public keys. So control node holds no secret,
+// that lets it impersonate a peer: it has its own key, that peers trust, and it trusts keys of peers.
+func PublicKeySigningMiddleware(key ed25519.PrivateKey, trusted ...ed25519.PublicKey) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		return &edSignWrapper{
+			next:    conn,
+			key:     key,
+			trusted: trusted,
+		}
+	}
+}
+
+func (w *edSignWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *edSignWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	buff := make([]byte, len(b)+edSignLen+1)
+	n, addr, err := w.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	if n < edSignLen+2 {
+		return 0, addr, rejected("too short")
+	}
+	sig := make([]byte, base64.StdEncoding.DecodedLen(edSignLen))
+	m, err := base64.StdEncoding.Decode(sig, buff[:edSignLen])
+	if err != nil || m != ed25519.SignatureSize {
+		return 0, addr, rejected("invalid signature")
+	}
+	data := buff[edSignLen+1 : n]
+	for _, pub := range w.trusted {
+		if ed25519.Verify(pub, data, sig[:m]) {
+			return copy(b, data), addr, nil
+		}
+	}
+	return 0, addr, rejected("invalid signature")
+}
+
+func (w *edSignWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	buff := make([]byte, edSignLen+1, edSignLen+1+len(b))
+	base64.StdEncoding.Encode(buff, ed25519.Sign(w.key, b))
+	buff[edSignLen] = ' '
+	_, err := w.next.WriteToUDP(append(buff, b...), addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil // pretend we wrote given data
+}
+
+// GenerateKey returns new private and public keys in text form, see ParsePrivateKey and ParsePublicKey.
+func GenerateKey() (string, string, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return privateKeyPrefix + base64.StdEncoding.EncodeToString(key.Seed()), publicKeyPrefix + base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// ParsePrivateKey parses key like "ed25519-private:BASE64-OF-SEED".
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := parseKey(s, privateKeyPrefix, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey parses key like "ed25519:BASE64".
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	return parseKey(s, publicKeyPrefix, ed25519.PublicKeySize)
+}
+
+// ParsePublicKeys reads public keys line by line. Empty lines and lines starting with # are skipped.
+func ParsePublicKeys(r io.Reader) ([]ed25519.PublicKey, error) {
+	keys := []ed25519.PublicKey(nil)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		key, err := ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		keys = append(keys, key)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys")
+	}
+	return keys, nil
+}
+
+func parseKey(s, prefix string, size int) ([]byte, error) {
+	enc, ok := strings.CutPrefix(strings.TrimSpace(s), prefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid key: %s prefix expected", prefix)
+	}
+	key, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("invalid key: invalid length: %d", len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,123 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func genKey(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey, string) {
+	t.Helper()
+	priv, pub, err := netpunchlib.GenerateKey()
+	require.NoError(t, err)
+	key, err := netpunchlib.ParsePrivateKey(priv)
+	require.NoError(t, err)
+	pubKey, err := netpunchlib.ParsePublicKey(pub)
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), pubKey)
+	return key, pubKey, pub
+}
+
+func TestPublicKeySigning(t *testing.T) {
+	key, pub, _ := genKey(t)
+	alien, _, _ := genKey(t)
+	m, queue := loopbackMock(t)
+	conn := netpunchlib.PublicKeySigningMiddleware(key, pub)(m)
+
+	n, err := conn.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Regexp(t, `^[A-Za-z0-9+/]{86}== data$`, string((*queue)[0]))
+	assert.Equal(t, "data", readString(t, conn))
+
+	_, err = netpunchlib.PublicKeySigningMiddleware(alien, pub)(m).WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	_, err = conn.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	(*queue)[1][len((*queue)[1])-1] = 'x' // tampered
+	*queue = append(*queue, []byte("short"), []byte(strings.Repeat("!", 88)+" data"))
+
+	assert.Equal(t, "message rejected: invalid signature", readErr(t, conn))
+	assert.Equal(t, "message rejected: invalid signature", readErr(t, conn))
+	assert.Equal(t, "message rejected: too short", readErr(t, conn))
+	assert.Equal(t, "message rejected: invalid signature", readErr(t, conn))
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	_, pub, err := netpunchlib.GenerateKey()
+	require.NoError(t, err)
+	keys, err := netpunchlib.ParsePublicKeys(strings.NewReader("# server\n" + pub + "\n\n" + pub + "\n"))
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	for text, errMsg := range map[string]string{
+		"":                 "no public keys",
+		"# nothing":        "no public keys",
+		"ed25519:AAAA":     "line 1: invalid key: invalid length: 3",
+		"ed25519-private:": "line 1: invalid key: ed25519: prefix expected",
+		"\ned25519:?":      "line 2: invalid key: illegal base64 data at input byte 0",
+	} {
+		t.Run(text, func(t *testing.T) {
+			_, err := netpunchlib.ParsePublicKeys(strings.NewReader(text))
+			require.EqualError(t, err, errMsg)
+		})
+	}
+}
+
+func TestPublicKeySigning_punch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverKey, serverPub, _ := genKey(t)
+	aKey, aPub, aText := genKey(t)
+	bKey, bPub, bText := genKey(t)
+	strangerKey, _, _ := genKey(t)
+
+	// control node binds public keys to identities, see CredentialsMiddleware
+	creds, err := netpunchlib.ParseCredentials(strings.NewReader("keys:a " + aText + "\nkeys:b " + bText + "\n"))
+	require.NoError(t, err)
+
+	ctrlAddr := "127.0.0.1:11100"
+	keys, err := creds.PublicKeys()
+	require.NoError(t, err)
+	secure := func(secret []byte) netpunchlib.ConnectionMiddleware {
+		return netpunchlib.PublicKeySigningMiddleware(serverKey, keys[string(secret)])
+	}
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"), netpunchlib.ConnOption(netpunchlib.CredentialsMiddleware(creds, secure)))
+	}()
+
+	type result struct {
+		path *netpunchlib.Path
+		err  error
+	}
+	punch := func(name string, port int, key ed25519.PrivateKey, opts ...netpunchlib.Option) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			opts = append(opts, opt(name), netpunchlib.ConnOption(netpunchlib.PublicKeySigningMiddleware(key, serverPub, aPub, bPub)))
+			path, err := netpunchlib.ClientPath(ctx, name, fmt.Sprintf("127.0.0.1:%d", port), ctrlAddr, opts...)
+			done <- result{path: path, err: err}
+		}()
+		return done
+	}
+
+	a := punch("keys:a", 11101, aKey)
+	b := punch("keys:b", 11102, bKey)
+	for _, done := range []<-chan result{a, b} {
+		r := <-done
+		require.NoError(t, r.err)
+	}
+
+	r := <-punch("keys:a", 11103, strangerKey, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...)
+	require.ErrorIs(t, r.err, netpunchlib.ErrServerUnreachable)
+	r = <-punch("keys:a", 11104, bKey, append(fastSchedule(), netpunchlib.MaxCyclesOption(2))...) // b can't take slot of a
+	require.ErrorIs(t, r.err, netpunchlib.ErrServerUnreachable)
+}
@@ -0,0 +1,190 @@
+package netpunchlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const maxKeyIDLen = 32
+
+// Key is shared secret with ID. ID goes to every signed message, so receiver knows which secret to verify it by.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring holds keys for KeyringSigningMiddleware: the first key signs messages, all keys verify them.
+// It is safe for concurrent use, so keys can be rotated by Set on the fly, without restarting.
+//
+// Rotation takes three steps, all sides have to complete each step before next one:
+// add new key after current one; move new key to the first place; remove old key.
+type Keyring struct {
+	mx      sync.RWMutex
+	signing Key
+	secrets map[string][]byte
+}
+
+// NewKeyring creates keyring, see Keyring.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	ring := &Keyring{mx: sync.RWMutex{}, signing: Key{ID: "", Secret: nil}, secrets: nil}
+	err := ring.Set(keys...)
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Set replaces all keys. The first key becomes signing one.
+func (r *Keyring) Set(keys ...Key) error {
+	if len(keys) == 0 {
+		return errors.New("keys: no keys")
+	}
+	secrets := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		if !validKeyID(k.ID) {
+			return fmt.Errorf("keys: invalid key ID %q", k.ID)
+		}
+		if len(k.Secret) == 0 {
+			return fmt.Errorf("keys: empty secret of key %q", k.ID)
+		}
+		if _, ok := secrets[k.ID]; ok {
+			return fmt.Errorf("keys: duplicate key ID %q", k.ID)
+		}
+		secrets[k.ID] = k.Secret
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.signing = keys[0]
+	r.secrets = secrets
+	return nil
+}
+
+func (r *Keyring) signingKey() Key {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.signing
+}
+
+func (r *Keyring) secret(id string) []byte {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.secrets[id]
+}
+
+// ParseKeys reads lines like "id secret". Empty lines and lines starting with # are skipped.
+// Key ID consists of letters, digits and -_.: characters, like 2024-10.
+func ParseKeys(r io.Reader) ([]Key, error) {
+	keys := []Key(nil)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		id, secret, _ := strings.Cut(s, " ")
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			return nil, fmt.Errorf("keys: line %d: key ID and secret expected", line)
+		}
+		if !validKeyID(id) {
+			return nil, fmt.Errorf("keys: line %d: invalid key ID %q", line, id)
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("keys: no keys")
+	}
+	return keys, nil
+}
+
+func validKeyID(id string) bool {
+	if id == "" || len(id) > maxKeyIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if !validNameChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+type keyringWrapper struct {
+	next Connection
+	ring *Keyring
+}
+
+// KeyringSigningMiddleware is like SigningMiddleware, however it signs messages by the signing key of keyring
+// and accepts messages signed by any key of keyring. Message looks like "ID SIGNATURE data".
+// It is not compatible with SigningMiddleware: all sides have to use keyrings.
+func KeyringSigningMiddleware(ring *Keyring) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		return &keyringWrapper{
+			next: conn,
+			ring: ring,
+		}
+	}
+}
+
+func (w *keyringWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *keyringWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	buff := make([]byte, len(b)+maxKeyIDLen+1+signLen+1)
+	n, addr, err := w.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	idLen := bytes.IndexByte(buff[:min(n, maxKeyIDLen+1)], ' ')
+	if idLen < 1 || n < idLen+1+signLen+2 {
+		return 0, addr, rejected("too short or no key ID")
+	}
+	id := string(buff[:idLen])
+	secret := w.ring.secret(id)
+	if secret == nil {
+		return 0, addr, rejected("unknown key ID " + id)
+	}
+	sign := buff[idLen+1 : idLen+1+signLen]
+	data := buff[idLen+1+signLen+1 : n]
+	sum, err := hmacSum(secret, data)
+	if err != nil {
+		return n, addr, err // consider summing errors as fatal, see signWrapper
+	}
+	if !hmac.Equal(sum, sign) {
+		return 0, addr, rejected("invalid signature, key ID " + id)
+	}
+	return copy(b, data), addr, nil
+}
+
+func (w *keyringWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	key := w.ring.signingKey()
+	sum, err := hmacSum(key.Secret, b)
+	if err != nil {
+		return 0, err
+	}
+	buff := make([]byte, 0, len(key.ID)+1+signLen+1+len(b))
+	buff = append(buff, key.ID...)
+	buff = append(buff, ' ')
+	buff = append(buff, sum...)
+	buff = append(buff, ' ')
+	buff = append(buff, b...)
+	_, err = w.next.WriteToUDP(buff, addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil // pretend we wrote given data
+}
@@ -0,0 +1,79 @@
+package netpunchlib_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func keyring(t *testing.T, text string) *netpunchlib.Keyring {
+	t.Helper()
+	keys, err := netpunchlib.ParseKeys(strings.NewReader(text))
+	require.NoError(t, err)
+	ring, err := netpunchlib.NewKeyring(keys...)
+	require.NoError(t, err)
+	return ring
+}
+
+func TestKeyringSigning_rotation(t *testing.T) {
+	m, queue := loopbackMock(t)
+	oldRing := keyring(t, "old old-secret\n")
+	sender := netpunchlib.KeyringSigningMiddleware(oldRing)(m)
+	ring := keyring(t, "old old-secret\nnew new-secret\n") // step 1: new key accepted
+	conn := netpunchlib.KeyringSigningMiddleware(ring)(m)
+
+	_, err := sender.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	assert.Regexp(t, `^old \S{40} data$`, string((*queue)[0]))
+	assert.Equal(t, "data", readString(t, conn))
+
+	require.NoError(t, oldRing.Set(netpunchlib.Key{ID: "new", Secret: []byte("new-secret")})) // step 2: new key signs
+	n, err := sender.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Regexp(t, `^new \S{40} data$`, string((*queue)[0]))
+	assert.Equal(t, "data", readString(t, conn))
+
+	require.NoError(t, ring.Set(netpunchlib.Key{ID: "new", Secret: []byte("new-secret")})) // step 3: old key removed
+	_, err = netpunchlib.KeyringSigningMiddleware(keyring(t, "old old-secret"))(m).WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "message rejected: unknown key ID old", readErr(t, conn))
+}
+
+func TestKeyringSigning_invalid(t *testing.T) {
+	m, queue := loopbackMock(t)
+	conn := netpunchlib.KeyringSigningMiddleware(keyring(t, "k secret"))(m)
+	_, err := netpunchlib.KeyringSigningMiddleware(keyring(t, "k alien"))(m).WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	*queue = append(*queue, []byte("k short"), []byte(strings.Repeat("x", 50)+" data"))
+
+	assert.Equal(t, "message rejected: invalid signature, key ID k", readErr(t, conn))
+	assert.Equal(t, "message rejected: too short or no key ID", readErr(t, conn))
+	assert.Equal(t, "message rejected: too short or no key ID", readErr(t, conn))
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := netpunchlib.ParseKeys(strings.NewReader("# current\n2024-10 new secret\n\n2024-09 old\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []netpunchlib.Key{{ID: "2024-10", Secret: []byte("new secret")}, {ID: "2024-09", Secret: []byte("old")}}, keys)
+
+	for text, errMsg := range map[string]string{
+		"":             "keys: no keys",
+		"secret":       "keys: line 1: key ID and secret expected",
+		"in/valid x":   `keys: line 1: invalid key ID "in/valid"`,
+		"#k x\n\nk\tx": "keys: line 3: key ID and secret expected",
+		"k x\nk y":     `keys: duplicate key ID "k"`,
+	} {
+		t.Run(text, func(t *testing.T) {
+			keys, err := netpunchlib.ParseKeys(strings.NewReader(text))
+			if err == nil {
+				_, err = netpunchlib.NewKeyring(keys...)
+			}
+			require.EqualError(t, err, errMsg)
+		})
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const rejectedReportInterval = time.Second
+
 type logInterface interface {
 	Print(v ...any)
 }
@@ -15,14 +20,22 @@ type logWrapper struct {
 	next     Connection
 	log      logInterface
 	isClosed *int32
+	mx       sync.Mutex
+	skipped  int // rejected packets, that are not reported yet
+	reported time.Time
 }
 
+// LoggingMiddleware logs all messages and errors. Rejected packets are reported not more often than once a second,
+// so flood doesn't flood logs as well; the next report tells how many of them are skipped.
 func LoggingMiddleware(log logInterface) ConnectionMiddleware {
 	return func(conn Connection) Connection {
 		return &logWrapper{
 			next:     conn,
 			log:      log,
 			isClosed: new(int32),
+			mx:       sync.Mutex{},
+			skipped:  0,
+			reported: time.Time{},
 		}
 	}
 }
@@ -40,6 +53,10 @@ func (w *logWrapper) Close() error {
 
 func (w *logWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
 	n, addr, err := w.next.ReadFromUDP(b)
+	if errors.Is(err, ErrRejected) { // not fatal, however it is worth to know who sends garbage
+		w.rejected(err, addr)
+		return n, addr, err
+	}
 	if err != nil {
 		w.err("read", err)
 		return n, addr, err
@@ -58,7 +75,27 @@ func (w *logWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	return n, err
 }
 
+func (w *logWrapper) rejected(err error, addr *net.UDPAddr) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	now := time.Now()
+	if now.Sub(w.reported) < rejectedReportInterval {
+		w.skipped++
+		return
+	}
+	msg := fmt.Sprintf("[warn] read: %s <- %s", err.Error(), addr)
+	if w.skipped > 0 {
+		msg += fmt.Sprintf(" (%d more rejected packets are not reported)", w.skipped)
+	}
+	w.log.Print(msg)
+	w.skipped = 0
+	w.reported = now
+}
+
 func (w *logWrapper) err(area string, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return // deadlines are used to interrupt reading, it is not an error
+	}
 	if atomic.AddInt32(w.isClosed, 0) != 0 {
 		opErr := (*net.OpError)(nil)
 		if errors.As(err, &opErr) {
@@ -0,0 +1,114 @@
+package netpunchlib
+
+import (
+	"net"
+	"time"
+)
+
+const maxRateLimitedIPs = 4096
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills bucket and takes one token if it is possible.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens = b.level(now, rate, burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) level(now time.Time, rate, burst float64) float64 {
+	return min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+}
+
+type rateLimitWrapper struct {
+	next       Connection
+	rate       float64
+	burst      float64
+	globalRate float64
+	global     tokenBucket
+	buckets    map[string]*tokenBucket // source IP -> bucket; reading is sequential, so no locks
+}
+
+// RateLimitMiddleware drops incoming packets over limits: rate packets per second from every source IP
+// with bursts up to burst packets, and globalRate packets per second in total. Zero rates mean no limits.
+// It is for control node: it has to be the first middleware, so excess packets cost no cryptography.
+// Siblings of ClusterOption use middlewares of ControlConnOption, so they are not limited.
+//
+//	ConnOption(RateLimitMiddleware(20, 40, 1000), SigningMiddleware(secret), LoggingMiddleware(logger))
+//
+// Every dropped packet is reported by ErrRejected, LoggingMiddleware doesn't let flood of them flood logs.
+func RateLimitMiddleware(rate float64, burst int, globalRate float64) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		return &rateLimitWrapper{
+			next:       conn,
+			rate:       rate,
+			burst:      float64(max(burst, 1)),
+			globalRate: globalRate,
+			global:     tokenBucket{tokens: max(globalRate, 1), last: time.Now()},
+			buckets:    map[string]*tokenBucket{},
+		}
+	}
+}
+
+func (w *rateLimitWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *rateLimitWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, addr, err := w.next.ReadFromUDP(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if !w.allow(time.Now(), addr) {
+		return 0, addr, rejected("rate limit exceeded")
+	}
+	return n, addr, nil
+}
+
+func (w *rateLimitWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return w.next.WriteToUDP(b, addr)
+}
+
+func (w *rateLimitWrapper) allow(now time.Time, addr *net.UDPAddr) bool {
+	if w.rate > 0 && !w.allowSource(now, addr) {
+		return false
+	}
+	return w.globalRate <= 0 || w.global.take(now, w.globalRate, max(w.globalRate, 1))
+}
+
+func (w *rateLimitWrapper) allowSource(now time.Time, addr *net.UDPAddr) bool {
+	key := ""
+	if addr != nil {
+		key = addr.IP.String()
+	}
+	bucket, ok := w.buckets[key]
+	if !ok {
+		w.evict(now)
+		bucket = &tokenBucket{tokens: w.burst, last: now}
+		w.buckets[key] = bucket
+	}
+	return bucket.take(now, w.rate, w.burst)
+}
+
+// evict forgets idle sources, their buckets are full; it forgets everybody if there are too many active sources,
+// total limit is the only protection in this case.
+func (w *rateLimitWrapper) evict(now time.Time) {
+	if len(w.buckets) < maxRateLimitedIPs {
+		return
+	}
+	for k, v := range w.buckets {
+		if v.level(now, w.rate, w.burst) >= w.burst {
+			delete(w.buckets, k)
+		}
+	}
+	if len(w.buckets) >= maxRateLimitedIPs {
+		w.buckets = map[string]*tokenBucket{}
+	}
+}
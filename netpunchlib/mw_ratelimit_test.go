@@ -0,0 +1,83 @@
+package netpunchlib_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/michurin/netpunch/netpunchlib"
+	"github.com/michurin/netpunch/netpunchlib/internal/mock"
+)
+
+// sourcesMock returns connection, that reads one packet from every given address in turn.
+func sourcesMock(t *testing.T, sources ...string) netpunchlib.Connection {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	m := mock.NewMockConnection(ctrl)
+	m.EXPECT().ReadFromUDP(gomock.Any()).DoAndReturn(func(b []byte) (int, *net.UDPAddr, error) {
+		require.NotEmpty(t, sources)
+		addr, err := net.ResolveUDPAddr("udp", sources[0])
+		require.NoError(t, err)
+		sources = sources[1:]
+		return copy(b, "data"), addr, nil
+	}).AnyTimes()
+	return m
+}
+
+func readAddr(t *testing.T, conn netpunchlib.Connection) string {
+	t.Helper()
+	buff := make([]byte, 1024)
+	n, addr, err := conn.ReadFromUDP(buff)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(buff[:n]))
+	return addr.String()
+}
+
+func TestRateLimit_perIP(t *testing.T) {
+	conn := netpunchlib.RateLimitMiddleware(0.001, 2, 0)(sourcesMock(t,
+		"1.1.1.1:1", "1.1.1.1:2", // burst
+		"1.1.1.1:3", "1.1.1.1:4", // dropped
+		"2.2.2.2:1", // other source
+	))
+
+	assert.Equal(t, "1.1.1.1:1", readAddr(t, conn))
+	assert.Equal(t, "1.1.1.1:2", readAddr(t, conn))
+	assert.Equal(t, "message rejected: rate limit exceeded", readErr(t, conn))
+	assert.Equal(t, "message rejected: rate limit exceeded", readErr(t, conn))
+	assert.Equal(t, "2.2.2.2:1", readAddr(t, conn))
+}
+
+func TestRateLimit_global(t *testing.T) {
+	conn := netpunchlib.RateLimitMiddleware(1000, 1000, 2)(sourcesMock(t, "1.1.1.1:1", "2.2.2.2:1", "3.3.3.3:1"))
+
+	assert.Equal(t, "1.1.1.1:1", readAddr(t, conn))
+	assert.Equal(t, "2.2.2.2:1", readAddr(t, conn))
+	assert.Equal(t, "message rejected: rate limit exceeded", readErr(t, conn))
+}
+
+type logRecorder []string
+
+func (r *logRecorder) Print(v ...any) {
+	*r = append(*r, fmt.Sprint(v...))
+}
+
+func TestRateLimit_logging(t *testing.T) {
+	logs := &logRecorder{}
+	conn := netpunchlib.ChainMiddleware(
+		netpunchlib.RateLimitMiddleware(0.001, 1, 0),
+		netpunchlib.LoggingMiddleware(logs),
+	)(sourcesMock(t, "1.1.1.1:1", "1.1.1.1:2", "1.1.1.1:3", "1.1.1.1:4"))
+
+	assert.Equal(t, "1.1.1.1:1", readAddr(t, conn))
+	for range 3 {
+		readErr(t, conn)
+	}
+	assert.Equal(t, []string{
+		`[info] read: "data" <- 1.1.1.1:1`,
+		"[warn] read: message rejected: rate limit exceeded <- 1.1.1.1:2", // the rest is not reported within a second
+	}, []string(*logs))
+}
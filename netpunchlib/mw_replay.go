@@ -0,0 +1,104 @@
+package netpunchlib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	replayHeaderLen        = 16 + 16 + 1 // hex timestamp, hex nonce and space
+	defaultReplayWindow    = 30 * time.Second
+	defaultReplayCacheSize = 4096
+)
+
+type replayWrapper struct {
+	next   Connection
+	window time.Duration
+	mx     sync.Mutex
+	seen   map[string]struct{}
+	order  []string // ring buffer of seen headers, it bounds the cache
+	pos    int
+}
+
+// ReplayProtectionMiddleware prepends timestamp and random nonce to every message, and drops messages,
+// that are out of freshness window or have been seen already.
+// It has to be put after SigningMiddleware, so signature covers timestamps and nonces:
+//
+//	ConnOption(SigningMiddleware(secret), ReplayProtectionMiddleware(window, cacheSize))
+//
+// Cache keeps cacheSize last headers; it has to be big enough to cover all messages of the window.
+// Zero window and cacheSize mean 30s and 4096.
+func ReplayProtectionMiddleware(window time.Duration, cacheSize int) ConnectionMiddleware {
+	if window <= 0 {
+		window = defaultReplayWindow
+	}
+	if cacheSize <= 0 {
+		cacheSize = defaultReplayCacheSize
+	}
+	return func(conn Connection) Connection {
+		return &replayWrapper{
+			next:   conn,
+			window: window,
+			mx:     sync.Mutex{},
+			seen:   make(map[string]struct{}, cacheSize),
+			order:  make([]string, cacheSize),
+			pos:    0,
+		}
+	}
+}
+
+func (w *replayWrapper) Close() error {
+	return w.next.Close()
+}
+
+func (w *replayWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	buff := make([]byte, len(b)+replayHeaderLen)
+	n, addr, err := w.next.ReadFromUDP(buff)
+	if err != nil {
+		return n, addr, err
+	}
+	if n < replayHeaderLen || buff[replayHeaderLen-1] != ' ' {
+		return 0, addr, rejected("no timestamp")
+	}
+	ts, err := strconv.ParseUint(string(buff[:16]), 16, 64)
+	if err != nil {
+		return 0, addr, rejected("no timestamp")
+	}
+	if age := time.Since(time.Unix(0, int64(ts))); age > w.window || age < -w.window { //nolint:gosec
+		return 0, addr, rejected("stale")
+	}
+	if !w.remember(string(buff[:replayHeaderLen-1])) {
+		return 0, addr, rejected("replayed")
+	}
+	return copy(b, buff[replayHeaderLen:n]), addr, nil
+}
+
+func (w *replayWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce) // it never returns an error
+	header := fmt.Sprintf("%016x%016x ", time.Now().UnixNano(), binary.BigEndian.Uint64(nonce))
+	_, err := w.next.WriteToUDP(append([]byte(header), b...), addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil // pretend we wrote given data
+}
+
+// remember returns false if header has been seen already.
+func (w *replayWrapper) remember(header string) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if _, ok := w.seen[header]; ok {
+		return false
+	}
+	delete(w.seen, w.order[w.pos]) // forget the oldest one
+	w.order[w.pos] = header
+	w.pos = (w.pos + 1) % len(w.order)
+	w.seen[header] = struct{}{}
+	return true
+}
@@ -0,0 +1,98 @@
+package netpunchlib_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/michurin/netpunch/netpunchlib"
+	"github.com/michurin/netpunch/netpunchlib/internal/mock"
+)
+
+// loopbackMock returns connection, that writes to and reads from the same queue of packets.
+func loopbackMock(t *testing.T) (*mock.MockConnection, *[][]byte) {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	queue := new([][]byte)
+	m := mock.NewMockConnection(ctrl)
+	m.EXPECT().WriteToUDP(gomock.Any(), gomock.Any()).DoAndReturn(func(b []byte, _ *net.UDPAddr) (int, error) {
+		*queue = append(*queue, append([]byte(nil), b...))
+		return len(b), nil
+	}).AnyTimes()
+	m.EXPECT().ReadFromUDP(gomock.Any()).DoAndReturn(func(b []byte) (int, *net.UDPAddr, error) {
+		require.NotEmpty(t, *queue)
+		n := copy(b, (*queue)[0])
+		*queue = (*queue)[1:]
+		return n, nil, nil
+	}).AnyTimes()
+	return m, queue
+}
+
+func replayConn(t *testing.T, window time.Duration, cacheSize int) (netpunchlib.Connection, *[][]byte) {
+	t.Helper()
+	m, queue := loopbackMock(t)
+	return netpunchlib.ReplayProtectionMiddleware(window, cacheSize)(m), queue
+}
+
+func readString(t *testing.T, conn netpunchlib.Connection) string {
+	t.Helper()
+	buff := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buff)
+	require.NoError(t, err)
+	return string(buff[:n])
+}
+
+func readErr(t *testing.T, conn netpunchlib.Connection) string {
+	t.Helper()
+	buff := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buff)
+	require.ErrorIs(t, err, netpunchlib.ErrRejected)
+	assert.Zero(t, n)
+	return err.Error()
+}
+
+func TestReplayProtection_replayed(t *testing.T) {
+	conn, queue := replayConn(t, 0, 0)
+	n, err := conn.WriteToUDP([]byte("data"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	require.Len(t, *queue, 1)
+	assert.Regexp(t, `^[0-9a-f]{32} data$`, string((*queue)[0]))
+	*queue = append(*queue, (*queue)[0]) // captured and replayed
+
+	assert.Equal(t, "data", readString(t, conn))
+	assert.Equal(t, "message rejected: replayed", readErr(t, conn))
+}
+
+func TestReplayProtection_invalid(t *testing.T) {
+	conn, queue := replayConn(t, time.Minute, 0)
+	*queue = [][]byte{
+		[]byte(fmt.Sprintf("%016x%016x data", time.Now().Add(-2*time.Minute).UnixNano(), 1)),
+		[]byte(fmt.Sprintf("%016x%016x data", time.Now().Add(2*time.Minute).UnixNano(), 1)),
+		[]byte("data"),
+		[]byte("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx data"),
+	}
+	assert.Equal(t, "message rejected: stale", readErr(t, conn))
+	assert.Equal(t, "message rejected: stale", readErr(t, conn))
+	assert.Equal(t, "message rejected: no timestamp", readErr(t, conn))
+	assert.Equal(t, "message rejected: no timestamp", readErr(t, conn))
+}
+
+func TestReplayProtection_boundedCache(t *testing.T) {
+	conn, queue := replayConn(t, 0, 1)
+	for _, m := range []string{"one", "two"} {
+		_, err := conn.WriteToUDP([]byte(m), nil)
+		require.NoError(t, err)
+	}
+	*queue = append(*queue, (*queue)[1], (*queue)[0])
+
+	assert.Equal(t, "one", readString(t, conn))
+	assert.Equal(t, "two", readString(t, conn))
+	assert.Equal(t, "message rejected: replayed", readErr(t, conn))
+	assert.Equal(t, "one", readString(t, conn)) // it has been pushed out of cache, window is the only protection
+}
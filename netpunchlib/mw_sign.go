@@ -35,14 +35,14 @@ func (w *signWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
 		return n, addr, err
 	}
 	if n < signLen+2 {
-		return copy(b, []byte("[message skipped, since it is too short]")), addr, nil // data too short, pretentd it is no data
+		return 0, addr, rejected("too short")
 	}
-	sum, err := w.sum(buff[signLen+1 : n])
+	sum, err := hmacSum(w.secret, buff[signLen+1:n])
 	if err != nil {
 		return n, addr, err // consider summing errors as fatal, they most likely refer to errors in code
 	}
 	if !hmac.Equal(sum, buff[:signLen]) { // do not use bytes.Equal, beware time leaking and timing attacks :)
-		return copy(b, []byte("[message skipped due to invalid signature]")), addr, nil // invalid signature, pretend it is no data
+		return 0, addr, rejected("invalid signature")
 	}
 	return copy(b, buff[signLen+1:n]), addr, nil
 }
@@ -50,7 +50,7 @@ func (w *signWrapper) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
 func (w *signWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	inputLen := len(b)
 	buff := make([]byte, inputLen+signLen+1)
-	sum, err := w.sum(b)
+	sum, err := hmacSum(w.secret, b)
 	if err != nil {
 		return 0, err
 	}
@@ -68,8 +68,9 @@ func (w *signWrapper) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	return inputLen, nil // return m to pretend we wrote given data
 }
 
-func (w *signWrapper) sum(data []byte) ([]byte, error) {
-	mac := hmac.New(sha256.New, w.secret)
+// hmacSum returns ascii85 encoded HMAC-SHA256 of data; it is always signLen bytes long.
+func hmacSum(secret, data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, secret)
 	_, err := mac.Write(data)
 	if err != nil {
 		return nil, err
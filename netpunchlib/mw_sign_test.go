@@ -74,3 +74,21 @@ func TestReadFromUDP_ok(t *testing.T) {
 	assert.Equal(t, []byte("data"), buff[:n])
 	assert.Nil(t, addr)
 }
+
+func TestReadFromUDP_rejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mock.NewMockConnection(ctrl)
+	m.EXPECT().ReadFromUDP(gomock.Any()).DoAndReturn(func(b []byte) (int, *net.UDPAddr, error) {
+		return copy(b, []byte(`VS2/W:Yo^Bl5K]QY&_nAD;I>W!Xe!?PY"r>0pm"S tampered`)), nil, nil
+	})
+
+	conn := netpunchlib.SigningMiddleware([]byte("MORN"))(m)
+	buff := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buff)
+
+	require.ErrorIs(t, err, netpunchlib.ErrRejected)
+	assert.EqualError(t, err, "message rejected: invalid signature")
+	assert.Equal(t, 0, n)
+}
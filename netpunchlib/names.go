@@ -0,0 +1,71 @@
+package netpunchlib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	maxNameLen    = 128
+	nameSeparator = ':'
+	legacySlotMin = 'a'
+	legacySlotMax = 'z'
+	legacyPrefix  = '~' // it is not valid in names, so legacy sessions never collide with named ones
+	nonceLen      = 16  // hex of 8 random bytes
+)
+
+// splitName splits peer name to session name and side.
+// Peer name looks like "session:side", e.g. "office-vpn:left".
+// Single letter a-z is legacy slot; it is paired with its neighbour: a-b, c-d and so on.
+// Legacy slots a and b make session ~ab, so they are not mixed up with peers and credentials of session ab.
+func splitName(name string) (string, string, error) {
+	if len(name) == 1 && name[0] >= legacySlotMin && name[0] <= legacySlotMax {
+		first := (name[0]-legacySlotMin)&^1 + legacySlotMin // a->a, b->a, c->c, d->c...
+		return string([]byte{legacyPrefix, first, first + 1}), name, nil
+	}
+	if len(name) > maxNameLen {
+		return "", "", fmt.Errorf("invalid peer name: too long: %d > %d", len(name), maxNameLen)
+	}
+	session, side, ok := strings.Cut(name, string(nameSeparator))
+	if !ok || session == "" || side == "" || strings.IndexByte(side, nameSeparator) >= 0 {
+		return "", "", fmt.Errorf("invalid peer name: %q: it has to look like session:side or be a letter a-z", name)
+	}
+	for _, c := range []byte(name) {
+		if !validNameChar(c) {
+			return "", "", fmt.Errorf("invalid peer name: %q: invalid character %q", name, c)
+		}
+	}
+	return session, side, nil
+}
+
+func validNameChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '-', c == '_', c == '.', c == nameSeparator:
+		return true
+	}
+	return false
+}
+
+// newNonce returns random identifier of run. Peers use it to tell expected peer apart from strangers
+// sitting at the same address and from previous runs of the same peer.
+func newNonce() string {
+	b := make([]byte, nonceLen/2)
+	_, _ = rand.Read(b) // it never returns an error
+	return hex.EncodeToString(b)
+}
+
+func validNonce(nonce string) bool {
+	if len(nonce) != nonceLen {
+		return false
+	}
+	for _, c := range []byte(nonce) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package netpunchlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const (
+	networkDualStack = "udp"
+	networkIPv4      = "udp4"
+	networkIPv6      = "udp6"
+	addrsSeparator   = ','
+)
+
+func checkNetwork(network string) error {
+	switch network {
+	case networkDualStack, networkIPv4, networkIPv6:
+		return nil
+	}
+	return fmt.Errorf("invalid network: %q: udp, udp4 or udp6 expected", network)
+}
+
+func isIPv4(addr *net.UDPAddr) bool {
+	return addr.IP.To4() != nil
+}
+
+// reachable reports whether socket bound to laddr is able to send packets to addr.
+func reachable(network string, laddr, addr *net.UDPAddr) bool {
+	switch network {
+	case networkIPv4:
+		return isIPv4(addr)
+	case networkIPv6:
+		return !isIPv4(addr)
+	}
+	if laddr.IP == nil || laddr.IP.IsUnspecified() { // Go listens wildcard addresses in dual-stack mode
+		return true
+	}
+	return isIPv4(laddr) == isIPv4(addr)
+}
+
+// resolveServers resolves main control node and extra ones, see ControlNodesOption.
+func resolveServers(ctx context.Context, config *Config, laddr *net.UDPAddr, address string) ([]*net.UDPAddr, error) {
+	addrs := []*net.UDPAddr(nil)
+	errs := []error(nil)
+	for _, a := range append([]string{address}, config.servers...) {
+		resolved, err := resolveAll(ctx, config.network, laddr, a)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addrs = mergeCandidates(addrs, resolved...)
+	}
+	if addrs == nil {
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
+
+// resolveAll resolves address to one IPv6 and one IPv4 address, IPv6 comes first.
+// For udp4 and udp6 networks it resolves address to one address of corresponding family.
+func resolveAll(ctx context.Context, network string, laddr *net.UDPAddr, address string) ([]*net.UDPAddr, error) {
+	if network != networkDualStack {
+		addr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPAddr{addr}, nil
+	}
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addr4, addr6 *net.UDPAddr
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if !reachable(network, laddr, addr) {
+			continue
+		}
+		if isIPv4(addr) {
+			if addr4 == nil {
+				addr4 = addr
+			}
+		} else if addr6 == nil {
+			addr6 = addr
+		}
+	}
+	addrs := []*net.UDPAddr(nil)
+	if addr6 != nil {
+		addrs = append(addrs, addr6)
+	}
+	if addr4 != nil {
+		addrs = append(addrs, addr4)
+	}
+	if addrs == nil {
+		return nil, fmt.Errorf("no reachable addresses: %s", address)
+	}
+	return addrs, nil
+}
+
+// parseAddrs parses list of literal addresses; it skips addresses that can not be reached from laddr.
+func parseAddrs(network string, laddr *net.UDPAddr, s string) []*net.UDPAddr {
+	addrs := []*net.UDPAddr(nil)
+	for _, a := range strings.Split(s, string(addrsSeparator)) {
+		ap, err := netip.ParseAddrPort(a) // it doesn't perform DNS lookups, unlike net.ResolveUDPAddr
+		if err != nil {
+			continue
+		}
+		addr := net.UDPAddrFromAddrPort(ap)
+		if !reachable(network, laddr, addr) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -0,0 +1,155 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func punchPair(t *testing.T, network, ctrlListen, ctrlAddr string, peers [2]string) [2]*net.UDPAddr {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	netOpt := netpunchlib.NetworkOption(network)
+
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlListen, opt("server"), netOpt)
+	}()
+
+	type result struct {
+		idx int
+		b   *net.UDPAddr
+		err error
+	}
+	done := make(chan result, 2)
+	for i, addr := range peers {
+		go func() {
+			_, b, err := netpunchlib.Client(ctx, []string{"a", "b"}[i], addr, ctrlAddr, opt("peer"), netOpt)
+			done <- result{idx: i, b: b, err: err}
+		}()
+	}
+
+	res := [2]*net.UDPAddr{}
+	for range peers {
+		r := <-done
+		require.NoError(t, r.err)
+		res[r.idx] = r.b
+	}
+	return res
+}
+
+func TestNetwork_dualStack(t *testing.T) {
+	// peers announce themselves via IPv4 and IPv6, and have to prefer IPv6
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", "localhost")
+	require.NoError(t, err)
+	families := map[bool]bool{}
+	for _, ip := range ips {
+		families[ip.To4() != nil] = true
+	}
+	if len(families) != 2 {
+		t.Skip("localhost has to be resolved to IPv4 and IPv6 addresses:", ips)
+	}
+	res := punchPair(t, "udp", ":10300", "localhost:10300", [2]string{":10301", ":10302"})
+	assert.Equal(t, "[::1]:10302", res[0].String())
+	assert.Equal(t, "[::1]:10301", res[1].String())
+}
+
+func TestNetwork_ipv4(t *testing.T) {
+	res := punchPair(t, "udp4", ":10310", "localhost:10310", [2]string{":10311", ":10312"})
+	assert.Equal(t, "127.0.0.1:10312", res[0].String())
+	assert.Equal(t, "127.0.0.1:10311", res[1].String())
+}
+
+func TestNetwork_ipv6(t *testing.T) {
+	probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}) //nolint:exhaustruct
+	if err != nil {
+		t.Skip("IPv6 loopback is not available:", err)
+	}
+	_ = probe.Close()
+	res := punchPair(t, "udp6", "[::1]:10320", "[::1]:10320", [2]string{"[::1]:10321", "[::1]:10322"})
+	assert.Equal(t, "[::1]:10322", res[0].String())
+	assert.Equal(t, "[::1]:10321", res[1].String())
+}
+
+func TestNetwork_invalid(t *testing.T) {
+	netOpt := netpunchlib.NetworkOption("tcp")
+	_, _, err := netpunchlib.Client(context.Background(), "a", ":0", "localhost:1", netOpt)
+	require.Error(t, err)
+	err = netpunchlib.Server(context.Background(), ":0", netOpt)
+	require.Error(t, err)
+}
+
+func skipWithoutPrivateAddrs(t *testing.T) {
+	t.Helper()
+	ifAddrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsPrivate() {
+			return
+		}
+	}
+	t.Skip("no private addresses on host")
+}
+
+func TestLocalCandidates(t *testing.T) {
+	// fake server hands out dead public addresses, so peers are able to reach each other by local candidates only
+	skipWithoutPrivateAddrs(t)
+
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer srv.Close()
+	go func() {
+		nonce := map[string]string{}
+		local := map[string]string{}
+		buff := make([]byte, 1024)
+		for {
+			n, addr, err := srv.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			flds := strings.Split(string(buff[:n]), "|")
+			if len(flds) != 4 {
+				continue
+			}
+			nonce[flds[1]] = flds[2]
+			local[flds[1]] = flds[3]
+			other := map[string]string{"a": "b", "b": "a"}[flds[1]]
+			if local[other] == "" {
+				continue
+			}
+			_, _ = srv.WriteToUDP([]byte("i|"+other+"|"+nonce[other]+"|0|127.0.0.1:1|"+local[other]), addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		b   *net.UDPAddr
+		err error
+	}
+	done := make(chan result, 2)
+	for i, name := range []string{"a", "b"} {
+		go func() {
+			_, b, err := netpunchlib.Client(ctx, name, fmt.Sprintf(":%d", 10401+i), srv.LocalAddr().String(),
+				opt("peer "+name), netpunchlib.LocalCandidatesOption())
+			done <- result{b: b, err: err}
+		}()
+	}
+	for range 2 {
+		r := <-done
+		require.NoError(t, r.err)
+		assert.False(t, r.b.IP.IsLoopback())
+		assert.True(t, r.b.Port == 10401 || r.b.Port == 10402)
+	}
+}
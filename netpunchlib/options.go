@@ -1,19 +1,76 @@
 package netpunchlib
 
+import (
+	"net"
+	"time"
+)
+
 type Config struct {
-	connMW []ConnectionMiddleware
+	connMW      []ConnectionMiddleware
+	controlMW   []ConnectionMiddleware
+	schedule    map[Phase]Backoff
+	maxCycles   int
+	timeout     time.Duration
+	network     string
+	local       bool
+	keepMW      bool
+	keepalive   *keepaliveConfig
+	relay       *relayConfig
+	relayAfter  int
+	predict     *predictConfig
+	slotTTL     time.Duration
+	consumeOnce bool
+	store       StateStore
+	registry    func(ttl time.Duration) Registry
+	servers     []string // extra control nodes
+	siblings    []string
+}
+
+const defaultSlotTTL = time.Minute
+
+type keepaliveConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+	handoff  <-chan struct{}
 }
 
 type Option func(cfg *Config)
 
 func newConfig(options ...Option) *Config {
-	cfg := new(Config)
+	cfg := &Config{
+		connMW:      nil,
+		controlMW:   nil,
+		schedule:    defaultSchedule(),
+		maxCycles:   0,
+		timeout:     0,
+		network:     networkDualStack,
+		local:       false,
+		keepMW:      false,
+		keepalive:   nil,
+		relay:       nil,
+		relayAfter:  0,
+		predict:     nil,
+		slotTTL:     defaultSlotTTL,
+		consumeOnce: false,
+		store:       nil,
+		registry:    nil,
+		servers:     nil,
+		siblings:    nil,
+	}
 	for _, o := range options {
 		o(cfg)
 	}
 	return cfg
 }
 
+// deadline returns time, when punching started right now times out (see TimeoutOption); zero time means never.
+func (c *Config) deadline() time.Time {
+	if c.timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.timeout)
+}
+
 func (c *Config) wrapConnection(conn Connection) Connection { //nolint:ireturn
 	for _, mw := range c.connMW {
 		conn = mw(conn)
@@ -21,8 +78,188 @@ func (c *Config) wrapConnection(conn Connection) Connection { //nolint:ireturn
 	return conn
 }
 
+// wrapClientConnection is like wrapConnection, however it takes into account ControlConnOption.
+func (c *Config) wrapClientConnection(conn Connection, controlAddrs []*net.UDPAddr) Connection { //nolint:ireturn
+	if c.controlMW == nil {
+		return c.wrapConnection(conn)
+	}
+	return newControlSplit(conn, controlAddrs, c.controlMW, c.connMW)
+}
+
 func ConnOption(mw ...ConnectionMiddleware) Option {
 	return func(cfg *Config) {
 		cfg.connMW = append(cfg.connMW, mw...)
 	}
 }
+
+// ControlConnOption sets separate middlewares for messages exchanged with control nodes;
+// middlewares of ConnOption are used for messages exchanged with peer only.
+// It allows client to authenticate itself to control node by individual secret (see CredentialsMiddleware)
+// and to peer by secret of session. Server uses them for messages exchanged with siblings, see ClusterOption.
+func ControlConnOption(mw ...ConnectionMiddleware) Option {
+	return func(cfg *Config) {
+		cfg.controlMW = append(cfg.controlMW, mw...)
+	}
+}
+
+// ChainMiddleware combines middlewares in the same order as ConnOption does: the first one is the closest to socket.
+func ChainMiddleware(mw ...ConnectionMiddleware) ConnectionMiddleware {
+	return func(conn Connection) Connection {
+		for _, m := range mw {
+			conn = m(conn)
+		}
+		return conn
+	}
+}
+
+// MaxCyclesOption limits number of discovery cycles; zero means no limit.
+// Client gives up with ErrServerUnreachable or ErrPeerUnreachable after the last cycle.
+func MaxCyclesOption(n int) Option {
+	return func(cfg *Config) {
+		cfg.maxCycles = n
+	}
+}
+
+// TimeoutOption sets hard deadline of punching; zero means no deadline.
+// Client gives up with ErrTimeout. Port prediction (see PortPredictionOption) is part of punching, it shares the deadline.
+func TimeoutOption(d time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.timeout = d
+	}
+}
+
+// NetworkOption sets network: "udp4", "udp6" or "udp" (dual-stack, default).
+func NetworkOption(network string) Option {
+	return func(cfg *Config) {
+		cfg.network = network
+	}
+}
+
+// LocalCandidatesOption makes client announce its local addresses and try to reach the peer by its local addresses.
+// It helps peers behind the same NAT.
+func LocalCandidatesOption() Option {
+	return func(cfg *Config) {
+		cfg.local = true
+	}
+}
+
+// KeepMiddlewareOption makes ClientConn return connection wrapped by middlewares,
+// so application payload is signed and logged as well as handshake messages.
+// Packets rejected by middlewares (see ErrRejected) are skipped by ReadFrom.
+func KeepMiddlewareOption() Option {
+	return func(cfg *Config) {
+		cfg.keepMW = true
+	}
+}
+
+// KeepaliveOption makes Client keep punched socket open and send keepalives to peer until handoff is closed.
+// Client fails with ErrPeerGone if peer's keepalives stop. Interval has to be positive and timeout has to be
+// longer than interval, otherwise Client fails right away. See Keepalive for details.
+func KeepaliveOption(interval, timeout time.Duration, handoff <-chan struct{}) Option {
+	return func(cfg *Config) {
+		cfg.keepalive = &keepaliveConfig{
+			interval: interval,
+			timeout:  timeout,
+			handoff:  handoff,
+		}
+	}
+}
+
+// RelayOption makes server relay traffic between peers, that are unable to reach each other directly.
+// Server allocates two relay ports per session from range minPort-maxPort (zeros mean ephemeral ports)
+// and releases them after idle period without traffic (one minute by default, one second at least).
+// See RelayAfterOption.
+func RelayOption(minPort, maxPort int, idle time.Duration) Option {
+	return func(cfg *Config) {
+		if idle <= 0 {
+			idle = time.Minute
+		}
+		idle = max(idle, minRelayIdle)
+		cfg.relay = &relayConfig{
+			minPort: minPort,
+			maxPort: maxPort,
+			idle:    idle,
+		}
+	}
+}
+
+// RelayAfterOption makes client ask server for relay after n failed punching cycles; zero means never.
+// Relay works only if both peers ask for it and server allows it (see RelayOption).
+func RelayAfterOption(n int) Option {
+	return func(cfg *Config) {
+		cfg.relayAfter = n
+	}
+}
+
+// PortPredictionOption helps to punch symmetric NAT, that allocates new port for each destination.
+// Before announcing, client asks main server and extra servers (at least one; it can be another port of the same
+// control node) about mapped ports, extrapolates the sequence and announces window of predicted ports.
+// Opposite peer sprays pings across these ports and locks onto whichever answers.
+// Window is limited by 64 ports.
+func PortPredictionOption(window int, servers ...string) Option {
+	return func(cfg *Config) {
+		cfg.predict = &predictConfig{
+			window:  window,
+			servers: servers,
+		}
+	}
+}
+
+// SlotTTLOption sets how long server keeps addresses of peer after its last announce (one minute by default).
+// It has to be longer than sleeping phase of peers (see ScheduleOption), otherwise peers can miss each other.
+// Server passes it to registry, see RegistryOption.
+func SlotTTLOption(ttl time.Duration) Option {
+	return func(cfg *Config) {
+		if ttl <= 0 {
+			ttl = defaultSlotTTL
+		}
+		cfg.slotTTL = ttl
+	}
+}
+
+// ConsumeOnceOption makes server forget peers as soon as they are paired: client confirms successful punching
+// by "done" message, server stops reporting the peer and clears the session when all its peers have confirmed.
+// So restarted peer is never paired with address of the previous run of opposite peer, that doesn't listen anymore.
+func ConsumeOnceOption() Option {
+	return func(cfg *Config) {
+		cfg.consumeOnce = true
+	}
+}
+
+// StateStoreOption makes server save registrations of peers to store and reload them on start,
+// so restart of control node doesn't interrupt pairings in progress. Registrations are saved every second
+// and on shutdown. Relays are not saved. Registry has to implement Snapshotter. See NewFileStore.
+func StateStoreOption(store StateStore) Option {
+	return func(cfg *Config) {
+		cfg.store = store
+	}
+}
+
+// RegistryOption replaces default in-memory registry of server (see NewMemoryRegistry).
+// Server creates registry by newRegistry on start and passes TTL of SlotTTLOption to it.
+func RegistryOption(newRegistry func(ttl time.Duration) Registry) Option {
+	return func(cfg *Config) {
+		cfg.registry = newRegistry
+	}
+}
+
+// ControlNodesOption adds control nodes for redundancy. Client announces itself to all control nodes at once
+// and uses the first peer info it gets. Control nodes, that can not be resolved, are skipped,
+// unless none of them can be resolved, including the main one.
+func ControlNodesOption(addresses ...string) Option {
+	return func(cfg *Config) {
+		cfg.servers = append(cfg.servers, addresses...)
+	}
+}
+
+// ClusterOption makes server replicate registrations to sibling control nodes and accept registrations
+// replicated by them, so peers, that talk to different control nodes, find each other.
+// Every control node of cluster has to list all others. Siblings are recognized by source address, that can be spoofed,
+// so ControlConnOption is required: messages to and from siblings pass its middlewares, that have to authenticate them.
+// Confirmations of ConsumeOnceOption are replicated too, however relay works only if both peers talk
+// to the same control node.
+func ClusterOption(siblings ...string) Option {
+	return func(cfg *Config) {
+		cfg.siblings = append(cfg.siblings, siblings...)
+	}
+}
@@ -0,0 +1,54 @@
+package netpunchlib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// packetConn turns Connection to net.PacketConn. Deadlines and local address are taken from raw socket.
+type packetConn struct {
+	next Connection
+	udp  *net.UDPConn
+}
+
+// ReadFrom skips rejected packets (see ErrRejected): forged or stray packet must not break reading loop of caller.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.next.ReadFromUDP(b)
+	for errors.Is(err, ErrRejected) {
+		n, addr, err = c.next.ReadFromUDP(b)
+	}
+	if addr == nil {
+		return n, nil, err // avoid non-nil interface with nil pointer
+	}
+	return n, addr, err
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("invalid address type: %T", addr)
+	}
+	return c.next.WriteToUDP(b, udpAddr)
+}
+
+func (c *packetConn) Close() error {
+	return c.next.Close()
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
@@ -0,0 +1,71 @@
+package netpunchlib
+
+import (
+	"context"
+	"net"
+)
+
+const maxPredictedPorts = 64
+
+type predictConfig struct {
+	window  int
+	servers []string
+}
+
+// predictionTargets returns main server and extra servers to ask about mapped addresses.
+// Main server goes first, so announces go through already mapped port and don't spoil the sequence.
+func predictionTargets(ctx context.Context, config *Config, laddr *net.UDPAddr, serverAddrs []*net.UDPAddr) ([]*net.UDPAddr, error) {
+	targets := []*net.UDPAddr{serverAddrs[len(serverAddrs)-1]} // prefer IPv4, NAT is mostly IPv4 business
+	for _, s := range config.predict.servers {
+		addrs, err := resolveAll(ctx, config.network, laddr, s)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, addrs[len(addrs)-1])
+	}
+	return targets, nil
+}
+
+// predictPorts guesses ports, that symmetric NAT is going to allocate for the next destinations.
+// It asks targets about mapped addresses (like Probe does) and extrapolates allocation step.
+func predictPorts(
+	ctx context.Context,
+	conn ConnectionWriter,
+	config *Config,
+	targets []*net.UDPAddr,
+	serverDataChan <-chan receivedMessage,
+	serverErrChan <-chan error,
+) ([]string, error) {
+	mapped, err := collectMapped(ctx, conn, config.schedule[PhaseDiscovering], targets, serverDataChan, serverErrChan)
+	if err != nil {
+		return nil, err
+	}
+	return extrapolatePorts(mapped, config.predict.window), nil
+}
+
+// extrapolatePorts continues sequence of mapped ports; it returns nothing if mapping doesn't change.
+func extrapolatePorts(mapped []*net.UDPAddr, window int) []string {
+	known := []*net.UDPAddr(nil)
+	for _, m := range mapped {
+		if m != nil {
+			known = append(known, m)
+		}
+	}
+	if len(known) < 2 {
+		return nil // not enough data, punch as usual
+	}
+	last := known[len(known)-1]
+	step := last.Port - known[len(known)-2].Port
+	if step == 0 {
+		return nil // endpoint-independent mapping, nothing to predict
+	}
+	addrs := []string(nil)
+	for k := 1; k <= window && k <= maxPredictedPorts; k++ {
+		port := last.Port + k*step
+		if port <= 0 || port > 0xffff {
+			break
+		}
+		addrs = append(addrs, (&net.UDPAddr{IP: last.IP, Port: port, Zone: last.Zone}).String())
+	}
+	return addrs
+}
@@ -0,0 +1,145 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+// symmetricNAT emulates NAT, that allocates new port for each destination (nextPort, nextPort+step...)
+// and accepts packets from this destination only. External sockets deliver packets to inside socket,
+// so reading is still interruptible by deadline.
+type symmetricNAT struct {
+	next     netpunchlib.Connection
+	inside   *net.UDPAddr
+	nextPort int
+	step     int
+	mx       sync.Mutex
+	outside  map[string]*net.UDPConn // destination -> external socket
+	remotes  map[int]*net.UDPAddr    // external port -> destination
+}
+
+func symmetricNATMiddleware(inside *net.UDPAddr, firstPort, step int) netpunchlib.ConnectionMiddleware {
+	return func(next netpunchlib.Connection) netpunchlib.Connection {
+		return &symmetricNAT{
+			next:     next,
+			inside:   inside,
+			nextPort: firstPort,
+			step:     step,
+			mx:       sync.Mutex{},
+			outside:  map[string]*net.UDPConn{},
+			remotes:  map[int]*net.UDPAddr{},
+		}
+	}
+}
+
+func (n *symmetricNAT) ReadFromUDP(data []byte) (int, *net.UDPAddr, error) {
+	for {
+		c, addr, err := n.next.ReadFromUDP(data)
+		if err != nil {
+			return c, addr, err
+		}
+		n.mx.Lock()
+		remote, ok := n.remotes[addr.Port]
+		n.mx.Unlock()
+		if ok {
+			return c, remote, nil
+		}
+	}
+}
+
+func (n *symmetricNAT) WriteToUDP(data []byte, addr *net.UDPAddr) (int, error) {
+	n.mx.Lock()
+	ext, ok := n.outside[addr.String()]
+	if !ok {
+		var err error
+		ext, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n.nextPort}) //nolint:exhaustruct
+		if err != nil {
+			n.mx.Unlock()
+			return 0, err
+		}
+		n.outside[addr.String()] = ext
+		n.remotes[n.nextPort] = addr
+		n.nextPort += n.step
+		go func() {
+			buff := make([]byte, 2048)
+			for {
+				c, src, err := ext.ReadFromUDP(buff)
+				if err != nil {
+					return // socket closed
+				}
+				if !src.IP.Equal(addr.IP) || src.Port != addr.Port {
+					continue // filtered out
+				}
+				_, _ = ext.WriteToUDP(buff[:c], n.inside)
+			}
+		}()
+	}
+	n.mx.Unlock()
+	return ext.WriteToUDP(data, addr)
+}
+
+func (n *symmetricNAT) Close() error {
+	n.mx.Lock()
+	for _, c := range n.outside {
+		_ = c.Close()
+	}
+	n.mx.Unlock()
+	return n.next.Close()
+}
+
+func TestPortPrediction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	netOpt := netpunchlib.NetworkOption("udp4")
+	for _, addr := range []string{"127.0.0.1:10930", "127.0.0.1:10931"} {
+		go func() {
+			_ = netpunchlib.Server(ctx, addr, opt("server"), netOpt)
+		}()
+	}
+
+	insideA := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10932} //nolint:exhaustruct
+	nat := netpunchlib.ConnOption(symmetricNATMiddleware(insideA, 10900, 2))
+
+	type result struct {
+		path *netpunchlib.Path
+		err  error
+	}
+	doneA := make(chan result, 1)
+	doneB := make(chan result, 1)
+	go func() {
+		path, err := netpunchlib.ClientPath(ctx, "a", insideA.String(), "127.0.0.1:10930",
+			nat, opt("a"), netOpt, netpunchlib.PortPredictionOption(4, "127.0.0.1:10931"))
+		doneA <- result{path: path, err: err}
+	}()
+	go func() {
+		path, err := netpunchlib.ClientPath(ctx, "b", "127.0.0.1:10933", "127.0.0.1:10930", opt("b"), netOpt)
+		doneB <- result{path: path, err: err}
+	}()
+
+	a := <-doneA
+	require.NoError(t, a.err)
+	b := <-doneB
+	require.NoError(t, b.err)
+	// a got 10900 for server, 10902 for extra server and 10904 (the first predicted port) for b
+	assert.Equal(t, "127.0.0.1:10904", b.path.RemoteAddr.String())
+	assert.Equal(t, "127.0.0.1:10933", a.path.RemoteAddr.String())
+}
+
+func TestPortPrediction_timeout(t *testing.T) {
+	srv := fakeServer(t, []byte("nothing useful"))              // it never tells mapped address
+	slow := netpunchlib.Backoff{Retries: 5, Delay: time.Second} //nolint:exhaustruct
+	start := time.Now()
+	_, _, err := netpunchlib.Client(context.Background(), "a", "127.0.0.1:0", srv, netpunchlib.TimeoutOption(200*time.Millisecond),
+		netpunchlib.ScheduleOption(netpunchlib.PhaseDiscovering, slow), netpunchlib.PortPredictionOption(4, srv))
+	require.ErrorIs(t, err, netpunchlib.ErrTimeout)
+	assert.Less(t, time.Since(start), time.Second) // prediction doesn't exceed timeout
+}
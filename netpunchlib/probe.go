@@ -0,0 +1,208 @@
+package netpunchlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// NATType is mapping behaviour of NAT in terms of RFC 4787.
+type NATType int
+
+const (
+	NATUnknown                 NATType = iota
+	NATNone                            // mapped address is local one
+	NATEndpointIndependent             // the same mapping for all destinations, punching works fine
+	NATAddressDependent                // mapping depends on destination IP
+	NATAddressAndPortDependent         // symmetric NAT, mapping depends on destination IP and port
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATNone:
+		return "none"
+	case NATEndpointIndependent:
+		return "endpoint-independent"
+	case NATAddressDependent:
+		return "address-dependent"
+	case NATAddressAndPortDependent:
+		return "symmetric"
+	case NATUnknown:
+	}
+	return "unknown"
+}
+
+// ProbeResult is result of NAT type detection.
+// Mapped contains addresses observed by servers, in order of servers; it is nil if server hasn't answered.
+// Partial means that all answered servers have the same IP, so address-dependent mapping
+// can not be told from endpoint-independent one.
+type ProbeResult struct {
+	Type    NATType
+	Mapped  []*net.UDPAddr
+	Partial bool
+}
+
+// Probe detects NAT type by comparing mapped addresses observed by servers.
+// You need at least two servers: one control node listening on two ports or two different control nodes.
+// The more different IPs and ports servers have, the more precise the result.
+// Probe uses PhaseDiscovering schedule for retries.
+func Probe(ctx context.Context, address string, servers []string, opt ...Option) (*ProbeResult, error) {
+	if len(servers) < 2 {
+		return nil, errors.New("at least two servers are required")
+	}
+	config := newConfig(opt...)
+	err := checkNetwork(config.network)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr(config.network, address)
+	if err != nil {
+		return nil, err
+	}
+	serverAddrs := make([]*net.UDPAddr, len(servers))
+	for i, s := range servers {
+		addrs, err := resolveAll(ctx, config.network, laddr, s)
+		if err != nil {
+			return nil, err
+		}
+		serverAddrs[i] = addrs[len(addrs)-1] // prefer IPv4, NAT is mostly IPv4 business
+	}
+
+	udpConn, err := net.ListenUDP(config.network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	boundPort := udpConn.LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert
+	conn := config.wrapClientConnection(udpConn, serverAddrs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()         // we must to cancel first
+		_ = conn.Close() // will be closed synchronously
+	}()
+
+	serverDataChan := make(chan receivedMessage)
+	serverErrChan := make(chan error)
+
+	go serve(ctx, conn, serverDataChan, serverErrChan)
+
+	mapped, err := collectMapped(ctx, conn, config.schedule[PhaseDiscovering], serverAddrs, serverDataChan, serverErrChan)
+	if err != nil {
+		return nil, err
+	}
+	answered := 0
+	for _, m := range mapped {
+		if m != nil {
+			answered++
+		}
+	}
+	if answered < 2 {
+		return nil, fmt.Errorf("%w: %d of %d servers answered", ErrServerUnreachable, answered, len(servers))
+	}
+	return classifyNAT(laddr, boundPort, serverAddrs, mapped), nil
+}
+
+func collectMapped(
+	ctx context.Context,
+	conn ConnectionWriter,
+	backoff Backoff,
+	serverAddrs []*net.UDPAddr,
+	serverDataChan <-chan receivedMessage,
+	serverErrChan <-chan error,
+) ([]*net.UDPAddr, error) {
+	mapped := make([]*net.UDPAddr, len(serverAddrs))
+	pending := len(serverAddrs)
+	for try := 1; try <= backoff.retries() && pending > 0; try++ {
+		for i, addr := range serverAddrs {
+			if mapped[i] != nil {
+				continue
+			}
+			_, err := conn.WriteToUDP([]byte{labelProbe}, addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		retry := time.After(backoff.delay(try))
+	WAIT:
+		for pending > 0 {
+			select {
+			case <-retry:
+				break WAIT
+			case data := <-serverDataChan:
+				flds := bytes.Split(data.message, []byte{labelsSeporator})
+				if len(flds) != 2 || len(flds[0]) != 1 || flds[0][0] != labelObserved {
+					continue // ignore invalid messages
+				}
+				ap, err := netip.ParseAddrPort(string(flds[1]))
+				if err != nil {
+					continue
+				}
+				for i, addr := range serverAddrs {
+					if mapped[i] == nil && addr.IP.Equal(data.addr.IP) && addr.Port == data.addr.Port {
+						mapped[i] = net.UDPAddrFromAddrPort(ap)
+						pending--
+					}
+				}
+			case err := <-serverErrChan:
+				return nil, err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return mapped, nil
+}
+
+func classifyNAT(laddr *net.UDPAddr, boundPort int, serverAddrs, mapped []*net.UDPAddr) *ProbeResult {
+	res := &ProbeResult{Type: NATEndpointIndependent, Mapped: mapped, Partial: true}
+	for i := range serverAddrs {
+		for j := range i {
+			if mapped[i] == nil || mapped[j] == nil {
+				continue
+			}
+			sameIP := serverAddrs[i].IP.Equal(serverAddrs[j].IP)
+			sameMapping := mapped[i].IP.Equal(mapped[j].IP) && mapped[i].Port == mapped[j].Port
+			switch {
+			case sameIP && !sameMapping:
+				res.Type = NATAddressAndPortDependent
+				return res
+			case !sameIP && !sameMapping:
+				res.Type = NATAddressDependent // we keep looking for address and port dependency
+				res.Partial = false
+			case !sameIP:
+				res.Partial = false
+			}
+		}
+	}
+	if res.Type == NATEndpointIndependent {
+		for _, m := range mapped {
+			if m != nil && isLocalAddr(laddr, boundPort, m) {
+				res.Type = NATNone
+				break
+			}
+		}
+	}
+	return res
+}
+
+func isLocalAddr(laddr *net.UDPAddr, boundPort int, addr *net.UDPAddr) bool {
+	if addr.Port != boundPort {
+		return false
+	}
+	if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		return laddr.IP.Equal(addr.IP)
+	}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestProbe_noNAT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	servers := []string{"127.0.0.1:10800", "127.0.0.1:10801"}
+	for _, s := range servers {
+		go func() {
+			_ = netpunchlib.Server(ctx, s, opt("server"))
+		}()
+	}
+
+	res, err := netpunchlib.Probe(ctx, "127.0.0.1:10802", servers, opt("probe"))
+	require.NoError(t, err)
+	assert.Equal(t, netpunchlib.NATNone, res.Type)
+	assert.True(t, res.Partial)
+	require.Len(t, res.Mapped, 2)
+	for _, m := range res.Mapped {
+		assert.Equal(t, "127.0.0.1:10802", m.String())
+	}
+}
+
+func TestProbe_classification(t *testing.T) {
+	one := net.IPv4(127, 0, 0, 1)
+	two := net.IPv4(127, 0, 0, 2)
+	type fake struct {
+		ip     net.IP
+		mapped string
+	}
+	for name, cs := range map[string]struct {
+		servers []fake
+		natType netpunchlib.NATType
+		partial bool
+	}{
+		"symmetric": {
+			servers: []fake{{one, "1.2.3.4:1000"}, {one, "1.2.3.4:1001"}},
+			natType: netpunchlib.NATAddressAndPortDependent,
+			partial: true,
+		},
+		"endpoint_independent_partial": {
+			servers: []fake{{one, "1.2.3.4:1000"}, {one, "1.2.3.4:1000"}},
+			natType: netpunchlib.NATEndpointIndependent,
+			partial: true,
+		},
+		"endpoint_independent": {
+			servers: []fake{{one, "1.2.3.4:1000"}, {two, "1.2.3.4:1000"}},
+			natType: netpunchlib.NATEndpointIndependent,
+			partial: false,
+		},
+		"address_dependent": {
+			servers: []fake{{one, "1.2.3.4:1000"}, {two, "1.2.3.4:1001"}, {one, "1.2.3.4:1000"}},
+			natType: netpunchlib.NATAddressDependent,
+			partial: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			servers := []string(nil)
+			for _, f := range cs.servers {
+				servers = append(servers, fakeServerAt(t, f.ip, []byte("o|"+f.mapped)))
+			}
+			res, err := netpunchlib.Probe(context.Background(), "127.0.0.1:0", servers, fastSchedule()...)
+			require.NoError(t, err)
+			assert.Equal(t, cs.natType, res.Type)
+			assert.Equal(t, cs.partial, res.Partial)
+			for i, f := range cs.servers {
+				assert.Equal(t, f.mapped, res.Mapped[i].String())
+			}
+		})
+	}
+}
+
+func TestProbe_serverUnreachable(t *testing.T) {
+	servers := []string{fakeServer(t, []byte("o|1.2.3.4:1000")), fakeServer(t, []byte("nothing useful"))}
+	_, err := netpunchlib.Probe(context.Background(), "127.0.0.1:0", servers, fastSchedule()...)
+	require.ErrorIs(t, err, netpunchlib.ErrServerUnreachable)
+	assert.EqualError(t, err, fmt.Sprintf("%s: 1 of 2 servers answered", netpunchlib.ErrServerUnreachable))
+}
@@ -0,0 +1,190 @@
+package netpunchlib
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Registry keeps peers registered on control node. Server uses MemoryRegistry by default;
+// custom registry can apply its own policies: access control, pairing rules, sharing state between control nodes.
+// Server calls it from single goroutine, however registry shared by several servers has to be safe for concurrent use.
+type Registry interface {
+	// Register saves announce of peer. Registration has one address, Addr4 or Addr6;
+	// peer can be registered by both, so registry has to keep both. Seen is time of announce.
+	// Peer is ignored if error is returned.
+	Register(reg Registration) error
+	// Lookup returns alive not paired peers of session except side, ordered by name.
+	Lookup(session, side string, now time.Time) []Registration
+	// Consume marks peer as paired, so it is not reported to anybody anymore; see ConsumeOnceOption.
+	// Peer is identified by name and nonce, so previous runs of peer can not be consumed.
+	Consume(session, side, name, nonce string)
+	// Expire forgets expired peers; server calls it periodically.
+	Expire(now time.Time)
+}
+
+// Snapshotter is registry, that can be saved to StateStore. MemoryRegistry is.
+type Snapshotter interface {
+	// Snapshot returns all alive registrations.
+	Snapshot(now time.Time) []Registration
+}
+
+// addrs returns all known addresses of peer, IPv6 comes first.
+func (r Registration) addrs() string {
+	if r.Addr4 == "" || r.Addr6 == "" {
+		return r.Addr6 + r.Addr4
+	}
+	return r.Addr6 + string(addrsSeparator) + r.Addr4
+}
+
+// ips returns IPs of all known addresses of peer.
+func (r Registration) ips() []net.IP {
+	ips := []net.IP(nil)
+	for _, a := range []string{r.Addr4, r.Addr6} {
+		ap, err := netip.ParseAddrPort(a)
+		if err == nil {
+			ips = append(ips, ap.Addr().AsSlice())
+		}
+	}
+	return ips
+}
+
+// age returns how old the record is in seconds.
+func (r Registration) age(now time.Time) string {
+	return strconv.Itoa(int(now.Sub(r.Seen).Seconds()))
+}
+
+// MemoryRegistry keeps last known addresses of peers grouped by sessions in memory.
+// Entries expire in ttl after the last announce, so peer, that has gone, is not reported to opposite peer.
+// It is safe for concurrent use.
+type MemoryRegistry struct {
+	mx       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]map[string]Registration // session -> side -> registration
+}
+
+// NewMemoryRegistry creates registry; ttl is like SlotTTLOption.
+func NewMemoryRegistry(ttl time.Duration) *MemoryRegistry {
+	if ttl <= 0 {
+		ttl = defaultSlotTTL
+	}
+	return &MemoryRegistry{
+		mx:       sync.Mutex{},
+		ttl:      ttl,
+		sessions: map[string]map[string]Registration{},
+	}
+}
+
+func (r *MemoryRegistry) expired(e Registration, now time.Time) bool {
+	return now.Sub(e.Seen) > r.ttl
+}
+
+// Register never fails. New run of peer (new nonce) and peer, that has been expired, forget previous addresses.
+func (r *MemoryRegistry) Register(reg Registration) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	members, ok := r.sessions[reg.Session]
+	if !ok {
+		members = map[string]Registration{}
+		r.sessions[reg.Session] = members
+	}
+	entry, ok := members[reg.Side]
+	if !ok || r.expired(entry, reg.Seen) || entry.Name != reg.Name || entry.Nonce != reg.Nonce {
+		entry = Registration{Session: reg.Session, Side: reg.Side, Name: reg.Name, Nonce: reg.Nonce} //nolint:exhaustruct
+	}
+	if reg.Local != "" { // relay requests don't bring local candidates
+		entry.Local = reg.Local
+	}
+	if reg.Predicted != "" { // predicted ports are IPv4 business, announce over IPv6 doesn't bring them
+		entry.Predicted = reg.Predicted
+	}
+	entry.Relay = reg.Relay
+	entry.Done = entry.Done || reg.Done // restored state can be already paired
+	entry.Seen = reg.Seen
+	entry.Expires = reg.Seen.Add(r.ttl)
+	if reg.Addr4 != "" {
+		entry.Addr4 = reg.Addr4
+	}
+	if reg.Addr6 != "" {
+		entry.Addr6 = reg.Addr6
+	}
+	members[reg.Side] = entry
+	return nil
+}
+
+// Lookup ignores expired entries even if they haven't been cleaned up yet.
+func (r *MemoryRegistry) Lookup(session, side string, now time.Time) []Registration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	peers := []Registration(nil)
+	for s, e := range r.sessions[session] {
+		if s == side || e.Done || r.expired(e, now) {
+			continue
+		}
+		peers = append(peers, e)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers
+}
+
+// Consume clears session as soon as all its peers are paired.
+func (r *MemoryRegistry) Consume(session, side, name, nonce string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	members := r.sessions[session]
+	entry, ok := members[side]
+	if !ok || entry.Name != name || entry.Nonce != nonce {
+		return // unknown peer or previous run
+	}
+	entry.Done = true
+	members[side] = entry
+	for _, e := range members {
+		if !e.Done {
+			return
+		}
+	}
+	delete(r.sessions, session)
+}
+
+// Expire forgets expired entries and empty sessions.
+func (r *MemoryRegistry) Expire(now time.Time) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for session, members := range r.sessions {
+		for side, e := range members {
+			if r.expired(e, now) {
+				delete(members, side)
+			}
+		}
+		if len(members) == 0 {
+			delete(r.sessions, session)
+		}
+	}
+}
+
+// Snapshot implements Snapshotter.
+func (r *MemoryRegistry) Snapshot(now time.Time) []Registration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	state := []Registration{}
+	for _, members := range r.sessions {
+		for _, e := range members {
+			if !r.expired(e, now) {
+				state = append(state, e)
+			}
+		}
+	}
+	return state
+}
+
+// announce is what peer tells about itself.
+type announce struct {
+	name      string
+	nonce     string
+	local     string
+	predicted string
+	relay     bool
+}
@@ -0,0 +1,75 @@
+package netpunchlib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func reg(side, nonce, addr string, seen time.Time) netpunchlib.Registration {
+	return netpunchlib.Registration{ //nolint:exhaustruct
+		Session: "s",
+		Side:    side,
+		Name:    "s:" + side,
+		Nonce:   nonce,
+		Addr4:   addr,
+		Seen:    seen,
+	}
+}
+
+func names(peers []netpunchlib.Registration) []string {
+	nn := []string(nil)
+	for _, p := range peers {
+		nn = append(nn, p.Name+"@"+p.Addr4+p.Addr6)
+	}
+	return nn
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	r := netpunchlib.NewMemoryRegistry(time.Minute)
+	now := time.Now()
+
+	require.NoError(t, r.Register(reg("c", "0000000000000003", "1.1.1.3:1", now)))
+	require.NoError(t, r.Register(reg("a", "0000000000000001", "1.1.1.1:1", now)))
+	ipv6 := reg("a", "0000000000000001", "", now)
+	ipv6.Addr6 = "[::1]:1"
+	require.NoError(t, r.Register(ipv6)) // the same run of peer keeps both addresses
+	require.NoError(t, r.Register(reg("b", "0000000000000002", "1.1.1.2:1", now)))
+	assert.Equal(t, []string{"s:a@1.1.1.1:1[::1]:1", "s:c@1.1.1.3:1"}, names(r.Lookup("s", "b", now)))
+
+	require.NoError(t, r.Register(reg("a", "000000000000000f", "1.1.1.1:2", now))) // new run forgets addresses
+	assert.Equal(t, []string{"s:a@1.1.1.1:2", "s:b@1.1.1.2:1"}, names(r.Lookup("s", "c", now)))
+
+	r.Consume("s", "a", "s:a", "0000000000000001") // previous run
+	r.Consume("s", "b", "s:b", "0000000000000002")
+	assert.Equal(t, []string{"s:a@1.1.1.1:2"}, names(r.Lookup("s", "c", now)))
+
+	later := now.Add(2 * time.Minute)
+	require.NoError(t, r.Register(reg("c", "0000000000000003", "1.1.1.3:1", later)))
+	assert.Empty(t, r.Lookup("s", "c", later)) // a is expired, b is paired
+	r.Expire(later)
+	assert.Equal(t, []string{"s:c@1.1.1.3:1"}, names(r.Snapshot(later)))
+}
+
+func TestMemoryRegistry_candidates(t *testing.T) {
+	r := netpunchlib.NewMemoryRegistry(time.Minute)
+	now := time.Now()
+
+	announce := reg("a", "0000000000000001", "1.1.1.1:1", now)
+	announce.Local = "10.0.0.1:1"
+	announce.Predicted = "1.1.1.1:2"
+	require.NoError(t, r.Register(announce))
+	relayReq := reg("a", "0000000000000001", "1.1.1.1:1", now)
+	relayReq.Relay = true
+	require.NoError(t, r.Register(relayReq)) // relay request doesn't bring candidates, they are kept
+
+	peers := r.Lookup("s", "b", now)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "10.0.0.1:1", peers[0].Local)
+	assert.Equal(t, "1.1.1.1:2", peers[0].Predicted)
+	assert.True(t, peers[0].Relay)
+}
@@ -0,0 +1,156 @@
+package netpunchlib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxRelays    = 256         // limits number of live relays; every relay takes two ports
+	minRelayIdle = time.Second // relay checks activity four times per idle period, it must not spin
+)
+
+type relayConfig struct {
+	minPort int
+	maxPort int
+	idle    time.Duration
+}
+
+// relay forwards packets between two peers, that are unable to reach each other directly.
+// Each peer gets its own port: packets from the first port go out of the second one and vice versa.
+// So each peer talks to the single address, it works even behind symmetric NATs.
+// Peer address is locked on the first packet that comes to its port from registered IP of peer;
+// port can differ from registered one, symmetric NATs allocate new port for every destination.
+type relay struct {
+	conns    [2]*net.UDPConn
+	mx       sync.Mutex
+	owners   [2][]net.IP // registered IPs of peers
+	peers    [2]atomic.Pointer[net.UDPAddr]
+	activity atomic.Int64 // unix nano of last forwarded packet
+	done     chan struct{}
+}
+
+func listenRelayPort(network string, ip net.IP, cfg *relayConfig) (*net.UDPConn, error) {
+	if cfg.minPort == 0 {
+		return net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: 0}) //nolint:exhaustruct
+	}
+	err := errors.New("empty range of relay ports")
+	for port := cfg.minPort; port <= cfg.maxPort; port++ {
+		conn, e := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port}) //nolint:exhaustruct
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+	return nil, err
+}
+
+func startRelay(ctx context.Context, network string, ip net.IP, cfg *relayConfig) (*relay, error) {
+	r := &relay{done: make(chan struct{})} //nolint:exhaustruct
+	for i := range r.conns {
+		conn, err := listenRelayPort(network, ip, cfg)
+		if err != nil {
+			for _, c := range r.conns[:i] {
+				_ = c.Close()
+			}
+			return nil, err
+		}
+		r.conns[i] = conn
+	}
+	r.activity.Store(time.Now().UnixNano())
+	wg := new(sync.WaitGroup)
+	for i := range r.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.forward(i)
+		}()
+	}
+	go func() {
+		r.watch(ctx, cfg.idle)
+		for _, c := range r.conns {
+			_ = c.Close() // it stops forwarding
+		}
+		wg.Wait()
+		close(r.done)
+	}()
+	return r, nil
+}
+
+func (r *relay) port(i int) int {
+	return r.conns[i].LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert
+}
+
+// allow lets peer lock its port from ips.
+func (r *relay) allow(i int, ips ...net.IP) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, ip := range ips {
+		if !slices.ContainsFunc(r.owners[i], ip.Equal) {
+			r.owners[i] = append(r.owners[i], ip)
+		}
+	}
+}
+
+// lock checks whether packet comes from peer of port i; it locks peer address on the first packet.
+func (r *relay) lock(i int, addr *net.UDPAddr) bool {
+	if locked := r.peers[i].Load(); locked != nil {
+		return locked.IP.Equal(addr.IP) && locked.Port == addr.Port
+	}
+	r.mx.Lock()
+	owner := slices.ContainsFunc(r.owners[i], addr.IP.Equal)
+	r.mx.Unlock()
+	if !owner {
+		return false
+	}
+	r.peers[i].Store(addr) // only forward(i) locks port i
+	return true
+}
+
+func (r *relay) alive() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *relay) watch(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, r.activity.Load())) > idle {
+				return
+			}
+		}
+	}
+}
+
+func (r *relay) forward(i int) {
+	buff := make([]byte, 2048)
+	for {
+		n, addr, err := r.conns[i].ReadFromUDP(buff)
+		if err != nil {
+			return // socket is closed
+		}
+		if !r.lock(i, addr) {
+			continue // stranger
+		}
+		peer := r.peers[1-i].Load()
+		if peer == nil {
+			continue // opposite peer hasn't come yet
+		}
+		r.activity.Store(time.Now().UnixNano())
+		_, _ = r.conns[1-i].WriteToUDP(buff[:n], peer)
+	}
+}
@@ -0,0 +1,160 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+// firewall pretends to send packets to blocked ports, however it drops them.
+type firewall struct {
+	netpunchlib.Connection
+	blocked map[int]bool
+}
+
+func (f *firewall) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if f.blocked[addr.Port] {
+		return len(b), nil
+	}
+	return f.Connection.WriteToUDP(b, addr)
+}
+
+func TestRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlAddr := "127.0.0.1:10700"
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"), netpunchlib.RelayOption(10710, 10719, time.Second))
+	}()
+
+	blocked := map[int]bool{10701: true, 10702: true} // peers can not reach each other directly
+	fw := netpunchlib.ConnOption(func(c netpunchlib.Connection) netpunchlib.Connection {
+		return &firewall{Connection: c, blocked: blocked}
+	})
+
+	type result struct {
+		path *netpunchlib.Path
+		err  error
+	}
+	done := make(chan result, 2)
+	for i, role := range []string{"a", "b"} {
+		go func() {
+			path, err := netpunchlib.ClientPath(ctx, role, fmt.Sprintf("127.0.0.1:%d", 10701+i), ctrlAddr,
+				append(fastSchedule(), opt("peer "+role), fw, netpunchlib.RelayAfterOption(1))...)
+			done <- result{path: path, err: err}
+		}()
+	}
+	for range 2 {
+		r := <-done
+		require.NoError(t, r.err)
+		assert.True(t, r.path.Relayed)
+		assert.GreaterOrEqual(t, r.path.RemoteAddr.Port, 10710)
+		assert.LessOrEqual(t, r.path.RemoteAddr.Port, 10719)
+	}
+}
+
+func TestRelay_direct(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrlAddr := "127.0.0.1:10720"
+	go func() {
+		_ = netpunchlib.Server(ctx, ctrlAddr, opt("server"), netpunchlib.RelayOption(0, 0, time.Second))
+	}()
+
+	done := make(chan *netpunchlib.Path, 2)
+	for i, role := range []string{"a", "b"} {
+		go func() {
+			path, err := netpunchlib.ClientPath(ctx, role, fmt.Sprintf("127.0.0.1:%d", 10721+i), ctrlAddr,
+				opt("peer "+role), netpunchlib.RelayAfterOption(1))
+			assert.NoError(t, err)
+			done <- path
+		}()
+	}
+	for range 2 {
+		path := <-done
+		require.NotNil(t, path)
+		assert.False(t, path.Relayed)
+	}
+}
+
+func TestRelay_strangers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:10730"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.RelayOption(0, 0, time.Second))
+	}()
+
+	listen := func(ip net.IP) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip}) //nolint:exhaustruct
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	relayAddr := func(reply string) *net.UDPAddr {
+		flds := strings.Split(reply, "|")
+		require.Len(t, flds, 4, reply)
+		port, err := strconv.Atoi(flds[3])
+		require.NoError(t, err)
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port} //nolint:exhaustruct
+	}
+	a, b := listen(net.IPv4(127, 0, 0, 1)), listen(net.IPv4(127, 0, 0, 1))
+	stranger := listen(net.IPv4(127, 0, 0, 2))
+
+	assert.Empty(t, ask(t, a, srv, "r|s:a|0123456789abcdef"))
+	relayB := relayAddr(ask(t, b, srv, "r|s:b|fedcba9876543210"))
+	relayA := relayAddr(ask(t, a, srv, "r|s:a|0123456789abcdef"))
+
+	// stranger comes first, however it doesn't take port of a
+	_, err := stranger.WriteToUDP([]byte("evil"), relayA)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = b.WriteToUDP([]byte("hi"), relayB) // b locks its port; a is not known yet, so it is dropped
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = a.WriteToUDP([]byte("hello"), relayA)
+	require.NoError(t, err)
+	buff := make([]byte, 1024)
+	require.NoError(t, b.SetReadDeadline(time.Now().Add(time.Second)))
+	n, addr, err := b.ReadFromUDP(buff)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buff[:n]))
+	assert.Equal(t, relayB.Port, addr.Port)
+
+	// restarted a gets new relay, the old one is locked to the previous run
+	assert.NotEqual(t, relayA.Port, relayAddr(ask(t, a, srv, "r|s:a|1111111111111111")).Port)
+}
+
+func TestRelay_disabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:10740"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server")) // no relay
+	}()
+
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer b.Close()
+
+	// relay request is plain announce, so peer, that has given up punching, still gets peer info
+	assert.Empty(t, ask(t, a, srv, "n|s:a|0123456789abcdef"))
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+a.LocalAddr().String(), ask(t, b, srv, "r|s:b|fedcba9876543210"))
+	assert.Equal(t, "i|s:b|fedcba9876543210|0|"+b.LocalAddr().String(), ask(t, a, srv, "r|s:a|0123456789abcdef"))
+}
@@ -0,0 +1,108 @@
+package netpunchlib
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Phase is a state of client FSM.
+type Phase int
+
+const (
+	PhaseDiscovering Phase = iota
+	PhasePinging
+	PhasePonging
+	PhaseClosing
+	PhaseSleeping
+)
+
+var phaseNames = map[Phase]string{ //nolint:gochecknoglobals
+	PhaseDiscovering: "discovery",
+	PhasePinging:     "ping",
+	PhasePonging:     "pong",
+	PhaseClosing:     "close",
+	PhaseSleeping:    "sleep",
+}
+
+func (p Phase) String() string {
+	if s, ok := phaseNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// ParsePhase is the opposite of Phase.String.
+func ParsePhase(s string) (Phase, error) {
+	for p, n := range phaseNames {
+		if n == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid phase: %q", s)
+}
+
+// Backoff describes how many times and how often the message of phase is sent.
+// Delay is growing by Multiplier on every retry up to MaxDelay (zero means 24 hours).
+// Multiplier less or equal to one means constant delay.
+// Jitter is fraction of delay, that is randomly added or subtracted, 0.1 means ±10%.
+type Backoff struct {
+	Retries    int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func defaultSchedule() map[Phase]Backoff {
+	return map[Phase]Backoff{
+		PhaseDiscovering: {Retries: 5, Delay: 100 * time.Millisecond},  //nolint:exhaustruct
+		PhasePinging:     {Retries: 10, Delay: 100 * time.Millisecond}, //nolint:exhaustruct
+		PhasePonging:     {Retries: 10, Delay: 100 * time.Millisecond}, //nolint:exhaustruct
+		PhaseClosing:     {Retries: 5, Delay: 20 * time.Millisecond},   //nolint:exhaustruct
+		PhaseSleeping:    {Retries: 1, Delay: 30 * time.Second},        //nolint:exhaustruct
+	}
+}
+
+func (b Backoff) retries() int {
+	if b.Retries < 1 {
+		return 1
+	}
+	return b.Retries
+}
+
+// maxBackoffDelay caps delays, when MaxDelay is not set; it keeps exponential growth away from overflows.
+const maxBackoffDelay = 24 * time.Hour
+
+// delay returns delay after try-th attempt; tries are counted from one.
+func (b Backoff) delay(try int) time.Duration {
+	limit := float64(maxBackoffDelay)
+	if b.MaxDelay > 0 && b.MaxDelay < maxBackoffDelay {
+		limit = float64(b.MaxDelay)
+	}
+	d := float64(b.Delay)
+	if b.Multiplier > 1 && try > 1 {
+		d *= math.Pow(b.Multiplier, float64(try-1)) // it can be +Inf, however it is clamped right below
+	}
+	if d > limit {
+		d = limit
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1) //nolint:gosec // jitter doesn't need cryptographic randomness
+	}
+	if d < 0 || math.IsNaN(d) {
+		return 0
+	}
+	if d > math.MaxInt64 { // huge jitter
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// ScheduleOption overrides default backoff of phase.
+func ScheduleOption(phase Phase, backoff Backoff) Option {
+	return func(cfg *Config) {
+		cfg.schedule[phase] = backoff
+	}
+}
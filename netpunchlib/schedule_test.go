@@ -0,0 +1,26 @@
+package netpunchlib_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+func TestParsePhase(t *testing.T) {
+	for _, p := range []netpunchlib.Phase{
+		netpunchlib.PhaseDiscovering,
+		netpunchlib.PhasePinging,
+		netpunchlib.PhasePonging,
+		netpunchlib.PhaseClosing,
+		netpunchlib.PhaseSleeping,
+	} {
+		q, err := netpunchlib.ParsePhase(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, q)
+	}
+	_, err := netpunchlib.ParsePhase("unknown")
+	require.Error(t, err)
+}
@@ -3,20 +3,48 @@ package netpunchlib
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"time"
 )
 
 func Server(ctx context.Context, address string, options ...Option) error {
 	config := newConfig(options...)
-	addr, err := net.ResolveUDPAddr("udp", address)
+	err := checkNetwork(config.network)
 	if err != nil {
 		return err
 	}
-	udpConn, err := net.ListenUDP("udp", addr)
+	addr, err := net.ResolveUDPAddr(config.network, address)
+	if err != nil {
+		return err
+	}
+	peers := Registry(nil)
+	if config.registry != nil {
+		peers = config.registry(config.slotTTL)
+	} else {
+		peers = NewMemoryRegistry(config.slotTTL)
+	}
+	err = restore(config.store, peers)
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	siblings, err := resolveSiblings(config.network, config.siblings)
+	if err != nil {
+		return err
+	}
+	if siblings != nil && config.controlMW == nil {
+		return errors.New("cluster requires ControlConnOption: source address of sibling can be spoofed")
+	}
+	udpConn, err := net.ListenUDP(config.network, addr)
 	if err != nil {
 		return err
 	}
 	conn := config.wrapConnection(udpConn)
+	if siblings != nil {
+		conn = config.wrapClientConnection(udpConn, siblings) // siblings are control nodes too
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer func() {
 		cancel()         // we must to cancel first
@@ -28,36 +56,363 @@ func Server(ctx context.Context, address string, options ...Option) error {
 
 	go serve(ctx, conn, serverDataChan, serverErrChan)
 
-	addresses := make([][]byte, 26)
+	node := &controlNode{
+		ctx:        ctx,
+		config:     config,
+		conn:       conn,
+		ip:         addr.IP,
+		peers:      peers,
+		relays:     map[string]*relay{},
+		siblings:   siblings,
+		replicated: map[string]time.Time{},
+		dirty:      false,
+	}
+
+	return node.run(serverDataChan, serverErrChan)
+}
+
+// run is server loop: it handles messages, expires registrations and saves them.
+func (n *controlNode) run(serverDataChan <-chan receivedMessage, serverErrChan <-chan error) error {
+	cleanup := time.NewTicker(n.config.slotTTL)
+	defer cleanup.Stop()
+	var saving <-chan time.Time // nil channel blocks forever
+	if n.config.store != nil {
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		saving = ticker.C
+	}
 
 	for {
 		select {
-		case data := <-serverDataChan:
-			if len(data.message) != 1 {
-				continue
-			}
-			slot := data.message[0]
-			if slot < 'a' || slot > 'z' {
-				continue
+		case now := <-cleanup.C:
+			n.peers.Expire(now)
+			n.forgetReplicated(now)
+			n.dirty = true
+		case <-saving:
+			err := n.save()
+			if err != nil {
+				return err
 			}
-			idx := int(slot - 'a')
-			addresses[idx] = bytes.Join([][]byte{ //nolint:gosec // we checked range before
-				{labelPeerInfo},
-				data.message[:1],
-				[]byte(data.addr.String()),
-			}, []byte{labelsSeporator})
-			payload := addresses[idx^1] //nolint:gosec // len is even
+		case data := <-serverDataChan:
+			payload := n.handle(data)
 			if payload == nil {
 				continue
 			}
-			_, err = conn.WriteToUDP(payload, data.addr)
+			_, err := n.conn.WriteToUDP(payload, data.addr)
 			if err != nil {
 				continue
 			}
 		case err := <-serverErrChan:
 			return err
-		case <-ctx.Done():
-			return ctx.Err()
+		case <-n.ctx.Done():
+			err := n.save()
+			if err != nil {
+				return err
+			}
+			return n.ctx.Err()
+		}
+	}
+}
+
+// restore loads saved registrations; expired ones are skipped.
+func restore(store StateStore, peers Registry) error {
+	if store == nil {
+		return nil
+	}
+	if _, ok := peers.(Snapshotter); !ok {
+		return errors.New("registry can not be saved")
+	}
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, reg := range state {
+		session, side, err := splitName(reg.Name)
+		if err != nil || now.After(reg.Expires) {
+			continue
+		}
+		reg.Session, reg.Side = session, side // state can be saved by previous version with other session keys
+		err = peers.Register(reg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save saves registrations if they could have been changed since the last saving.
+func (n *controlNode) save() error {
+	if n.config.store == nil || !n.dirty {
+		return nil
+	}
+	err := n.config.store.Save(n.peers.(Snapshotter).Snapshot(time.Now())) //nolint:forcetypeassert // checked in restore
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	n.dirty = false
+	return nil
+}
+
+// controlNode keeps state of server. It is not thread safe, it is used in server loop only.
+type controlNode struct {
+	ctx        context.Context //nolint:containedctx // relays live as long as server
+	config     *Config
+	conn       ConnectionWriter
+	ip         net.IP // listening address, relays use it too
+	peers      Registry
+	relays     map[string]*relay // session -> relay
+	siblings   []*net.UDPAddr    // see ClusterOption
+	replicated map[string]time.Time
+	dirty      bool // registrations are not saved yet, see StateStore
+}
+
+// handle returns reply to message or nil.
+func (n *controlNode) handle(data receivedMessage) []byte {
+	flds := bytes.Split(data.message, []byte{labelsSeporator})
+	if len(flds[0]) != 1 {
+		return nil
+	}
+	if flds[0][0] == labelProbe { // the only message without fields
+		if len(flds) != 1 {
+			return nil
+		}
+		return bytes.Join([][]byte{
+			{labelObserved},
+			[]byte(data.addr.String()),
+		}, []byte{labelsSeporator})
+	}
+	if len(flds) < 2 {
+		return nil
+	}
+	switch flds[0][0] {
+	case labelAnnounce:
+		return n.handleAnnounce(data.addr, flds)
+	case labelRelayReq:
+		if len(flds) != 3 {
+			return nil
+		}
+		relay := n.config.relay != nil // without relay it is plain announce, peer waits for peer info anyway
+		return n.announce(data.addr, announce{name: string(flds[1]), nonce: string(flds[2]), local: "", predicted: "", relay: relay})
+	case labelGroup:
+		return n.handleGroup(data.addr, flds)
+	case labelDone:
+		n.handleDone(data, flds)
+		return nil // no reply, client doesn't wait for it
+	case labelSync:
+		if len(flds) == 8 && n.sibling(data.addr) {
+			n.sync(flds)
+		}
+		return nil
+	}
+	return nil
+}
+
+// handleAnnounce handles n|name|nonce[|local[|predicted]].
+func (n *controlNode) handleAnnounce(addr *net.UDPAddr, flds [][]byte) []byte {
+	if len(flds) < 3 || len(flds) > 5 {
+		return nil
+	}
+	ann := announce{name: string(flds[1]), nonce: string(flds[2]), local: "", predicted: "", relay: false}
+	if len(flds) >= 4 {
+		ann.local = sanitizeCandidates(string(flds[3]), maxLocalCandidates, privateAddr)
+	}
+	if len(flds) == 5 {
+		ann.predicted = sanitizeCandidates(string(flds[4]), maxPredictedPorts, sameIP(addr.IP))
+	}
+	return n.announce(addr, ann)
+}
+
+// handleGroup handles g|name|nonce|size[|local].
+func (n *controlNode) handleGroup(addr *net.UDPAddr, flds [][]byte) []byte {
+	if len(flds) < 4 || len(flds) > 5 {
+		return nil
+	}
+	size, err := strconv.Atoi(string(flds[3]))
+	if err != nil || size < 2 || size > maxGroupSize {
+		return nil
+	}
+	ann := announce{name: string(flds[1]), nonce: string(flds[2]), local: "", predicted: "", relay: false}
+	if len(flds) == 5 {
+		ann.local = sanitizeCandidates(string(flds[4]), maxLocalCandidates, privateAddr)
+	}
+	return n.joinGroup(addr, ann, size)
+}
+
+// handleDone handles d|name|nonce, see ConsumeOnceOption.
+func (n *controlNode) handleDone(data receivedMessage, flds [][]byte) {
+	if len(flds) != 3 || !n.config.consumeOnce {
+		return
+	}
+	session, side, err := splitName(string(flds[1]))
+	if err != nil {
+		return
+	}
+	n.peers.Consume(session, side, string(flds[1]), string(flds[2]))
+	n.dirty = true
+	if !n.sibling(data.addr) {
+		_ = writeAll(n.conn, data.message, n.siblings)
+	}
+}
+
+func (n *controlNode) announce(addr *net.UDPAddr, ann announce) []byte {
+	session, side, err := splitName(ann.name)
+	if err != nil || !validNonce(ann.nonce) {
+		return nil
+	}
+	now := time.Now()
+	if !n.register(session, side, addr, ann, now) {
+		return nil
+	}
+	peer, ok := latest(n.peers.Lookup(session, side, now))
+	if !ok {
+		return nil
+	}
+	if ann.relay && peer.Relay {
+		port, ok := n.relayPort(n.self(session, side, addr, ann, peer, now), peer)
+		if ok {
+			return bytes.Join([][]byte{
+				{labelRelayInfo},
+				[]byte(peer.Name),
+				[]byte(peer.Nonce),
+				[]byte(strconv.Itoa(port)),
+			}, []byte{labelsSeporator})
+		}
+	}
+	payloadFields := [][]byte{
+		{labelPeerInfo},
+		[]byte(peer.Name),
+		[]byte(peer.Nonce),
+		[]byte(peer.age(now)),
+		[]byte(peer.addrs()),
+	}
+	if peer.Local != "" || peer.Predicted != "" {
+		payloadFields = append(payloadFields, []byte(peer.Local))
+	}
+	if peer.Predicted != "" {
+		payloadFields = append(payloadFields, []byte(peer.Predicted))
+	}
+	return bytes.Join(payloadFields, []byte{labelsSeporator})
+}
+
+// joinGroup registers member of group session and returns all other members:
+// m|name|nonce|age|addrs|local|name|nonce|age|addrs|local...
+// New member is refused if group of given size is full already, so extra members can not crowd out real ones.
+// Members, that don't fit into single packet, are not reported.
+func (n *controlNode) joinGroup(addr *net.UDPAddr, ann announce, size int) []byte {
+	session, side, err := splitName(ann.name)
+	if err != nil || len(ann.name) == 1 || !validNonce(ann.nonce) { // legacy slots are pairs by design
+		return nil
+	}
+	now := time.Now()
+	if len(n.peers.Lookup(session, side, now)) >= size { // member, that is registered already, is not counted
+		return nil
+	}
+	if !n.register(session, side, addr, ann, now) {
+		return nil
+	}
+	payload := []byte{labelMembers}
+	for i, peer := range n.peers.Lookup(session, side, now) {
+		member := bytes.Join([][]byte{
+			[]byte(peer.Name),
+			[]byte(peer.Nonce),
+			[]byte(peer.age(now)),
+			[]byte(peer.addrs()),
+			[]byte(peer.Local),
+		}, []byte{labelsSeporator})
+		if i >= size-1 || len(payload)+1+len(member) > maxMembersPayload {
+			break
+		}
+		payload = append(append(payload, labelsSeporator), member...)
+	}
+	if len(payload) == 1 {
+		return nil // nobody to report about
+	}
+	return payload
+}
+
+// register passes announce to registry; it reports whether peer is accepted.
+func (n *controlNode) register(session, side string, addr *net.UDPAddr, ann announce, now time.Time) bool {
+	reg := Registration{ //nolint:exhaustruct
+		Session:   session,
+		Side:      side,
+		Name:      ann.name,
+		Nonce:     ann.nonce,
+		Local:     ann.local,
+		Predicted: ann.predicted,
+		Relay:     ann.relay,
+		Seen:      now,
+	}
+	if isIPv4(addr) {
+		reg.Addr4 = addr.String()
+	} else {
+		reg.Addr6 = addr.String()
+	}
+	n.dirty = true
+	if n.peers.Register(reg) != nil {
+		return false
+	}
+	n.replicate(reg, now)
+	return true
+}
+
+// latest returns the most recently seen peer.
+func latest(peers []Registration) (Registration, bool) {
+	peer := Registration{} //nolint:exhaustruct
+	found := false
+	for _, p := range peers {
+		if !found || p.Seen.After(peer.Seen) {
+			peer = p
+			found = true
+		}
+	}
+	return peer, found
+}
+
+// self returns registration of announcing peer; it knows all addresses of peer, not only the current one.
+func (n *controlNode) self(session, side string, addr *net.UDPAddr, ann announce, peer Registration, now time.Time) Registration {
+	for _, r := range n.peers.Lookup(session, peer.Side, now) {
+		if r.Side == side && r.Nonce == ann.nonce {
+			return r
+		}
+	}
+	self := Registration{Session: session, Side: side, Name: ann.name, Nonce: ann.nonce} //nolint:exhaustruct // registry refuses to tell
+	if isIPv4(addr) {
+		self.Addr4 = addr.String()
+	} else {
+		self.Addr6 = addr.String()
+	}
+	return self
+}
+
+// relayPort returns relay port for self; it allocates relay if needed.
+// Relay belongs to particular runs of both peers, restarted peer gets new relay.
+func (n *controlNode) relayPort(self, peer Registration) (int, bool) {
+	for k, r := range n.relays { // forget stopped relays
+		if !r.alive() {
+			delete(n.relays, k)
+		}
+	}
+	slot := 0
+	first, second := self, peer
+	if peer.Side < self.Side { // the same rule for both peers
+		slot = 1
+		first, second = peer, self
+	}
+	key := self.Session + string(labelsSeporator) + first.Nonce + string(labelsSeporator) + second.Nonce
+	r, ok := n.relays[key]
+	if !ok {
+		if len(n.relays) >= maxRelays {
+			return 0, false // fall back to peer info
+		}
+		var err error
+		r, err = startRelay(n.ctx, n.config.network, n.ip, n.config.relay)
+		if err != nil {
+			return 0, false
 		}
+		n.relays[key] = r
 	}
+	r.allow(slot, self.ips()...) // peer can come by new addresses
+	r.allow(1-slot, peer.ips()...)
+	return r.port(slot), true
 }
@@ -0,0 +1,227 @@
+package netpunchlib_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/michurin/netpunch/netpunchlib"
+)
+
+// ask sends message to server and returns reply or empty string if server keeps silence.
+func ask(t *testing.T, conn *net.UDPConn, srv, message string) string {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", srv)
+	require.NoError(t, err)
+	buff := make([]byte, 1024)
+	for range 10 { // server can be not ready yet
+		_, err = conn.WriteToUDP([]byte(message), addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		n, _, err := conn.ReadFromUDP(buff)
+		if err == nil {
+			return string(buff[:n])
+		}
+	}
+	return ""
+}
+
+func TestServer_slotTTL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11200"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.SlotTTLOption(time.Second))
+	}()
+
+	peers := [2]*net.UDPConn{}
+	for i := range peers {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer conn.Close()
+		peers[i] = conn
+	}
+
+	assert.Empty(t, ask(t, peers[0], srv, "n|s:a|0123456789abcdef")) // nobody to report about, server keeps silence
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+peers[0].LocalAddr().String(), ask(t, peers[1], srv, "n|s:b|fedcba9876543210"))
+
+	time.Sleep(1500 * time.Millisecond)                              // a is gone
+	assert.Empty(t, ask(t, peers[1], srv, "n|s:b|fedcba9876543210")) // b is still here
+	assert.Equal(t, "i|s:b|fedcba9876543210|0|"+peers[1].LocalAddr().String(), ask(t, peers[0], srv, "n|s:a|0123456789abcdef"))
+}
+
+func TestServer_consumeOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11210"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.ConsumeOnceOption())
+	}()
+
+	done := make(chan error, 2)
+	for i, name := range []string{"a", "b"} {
+		go func() {
+			_, _, err := netpunchlib.Client(ctx, name, fmt.Sprintf("127.0.0.1:%d", 11211+i), srv, opt("peer "+name))
+			done <- err
+		}()
+	}
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+
+	// a has gone, restarted b must not get its address
+	_, _, err := netpunchlib.Client(ctx, "b", "127.0.0.1:11212", srv, append(fastSchedule(), opt("peer b"), netpunchlib.MaxCyclesOption(1))...)
+	require.ErrorIs(t, err, netpunchlib.ErrServerUnreachable)
+
+	// however, new run of a is welcome
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Regexp(t, `^i\|b\|[0-9a-f]{16}\|0\|127\.0\.0\.1:11212$`, ask(t, conn, srv, "n|a|0123456789abcdef"))
+}
+
+func TestFileStore(t *testing.T) {
+	store := netpunchlib.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	state, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, state)
+
+	now := time.Now().Round(0).UTC()
+	saved := []netpunchlib.Registration{{
+		Session:   "s",
+		Side:      "a",
+		Name:      "s:a",
+		Nonce:     "0123456789abcdef",
+		Addr4:     "1.2.3.4:5",
+		Addr6:     "",
+		Local:     "",
+		Predicted: "",
+		Relay:     false,
+		Done:      true,
+		Seen:      now,
+		Expires:   now.Add(time.Minute),
+	}}
+	require.NoError(t, store.Save(saved))
+	state, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, saved, state)
+}
+
+func TestServer_stateStore(t *testing.T) {
+	srv := "127.0.0.1:11230"
+	store := netpunchlib.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	stopped := make(chan error)
+	go func() {
+		stopped <- netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.StateStoreOption(store))
+	}()
+	assert.Empty(t, ask(t, conn, srv, "n|s:a|0123456789abcdef"))
+	cancel()
+	require.ErrorIs(t, <-stopped, context.Canceled) // state is saved on shutdown
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.StateStoreOption(store))
+	}()
+	// restarted server still knows about a
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+conn.LocalAddr().String(), ask(t, conn, srv, "n|s:b|fedcba9876543210"))
+}
+
+// aclRegistry refuses peers, that are not allowed.
+type aclRegistry struct {
+	*netpunchlib.MemoryRegistry
+	allowed map[string]bool
+}
+
+func (r aclRegistry) Register(reg netpunchlib.Registration) error {
+	if !r.allowed[reg.Name] {
+		return errors.New("not allowed: " + reg.Name)
+	}
+	return r.MemoryRegistry.Register(reg)
+}
+
+func TestServer_registry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11240"
+	ttls := make(chan time.Duration, 2)
+	newRegistry := func(slotTTL time.Duration) netpunchlib.Registry {
+		ttls <- slotTTL
+		return aclRegistry{MemoryRegistry: netpunchlib.NewMemoryRegistry(slotTTL), allowed: map[string]bool{"s:a": true, "s:b": true}}
+	}
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"), netpunchlib.RegistryOption(newRegistry), netpunchlib.SlotTTLOption(time.Hour))
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Empty(t, ask(t, conn, srv, "n|s:x|0123456789abcdef")) // refused
+	assert.Empty(t, ask(t, conn, srv, "n|s:a|0123456789abcdef"))
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+conn.LocalAddr().String(), ask(t, conn, srv, "n|s:b|fedcba9876543210"))
+	assert.Empty(t, ask(t, conn, srv, "n|s:x|0123456789abcdef")) // refused peer doesn't get anything
+	assert.Equal(t, time.Hour, <-ttls)                           // server passes its TTL to registry
+
+	// registry without snapshots can not be saved
+	opaque := func(ttl time.Duration) netpunchlib.Registry { return struct{ netpunchlib.Registry }{newRegistry(ttl)} }
+	err = netpunchlib.Server(ctx, "127.0.0.1:0", netpunchlib.RegistryOption(opaque), netpunchlib.StateStoreOption(netpunchlib.NewFileStore("-")))
+	require.EqualError(t, err, "state: registry can not be saved")
+}
+
+func TestServer_candidates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11260"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"))
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// third-party addresses are dropped: local candidates have to be private, predicted ones have to share IP of peer
+	assert.Empty(t, ask(t, conn, srv, "n|s:a|0123456789abcdef|8.8.8.8:53,192.168.1.2:5000,[fe80::1]:5000|9.9.9.9:53,127.0.0.1:7000"))
+	assert.Equal(t, "i|s:a|0123456789abcdef|0|"+conn.LocalAddr().String()+"|192.168.1.2:5000,[fe80::1]:5000|127.0.0.1:7000",
+		ask(t, conn, srv, "n|s:b|fedcba9876543210"))
+}
+
+func TestServer_legacySlots(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := "127.0.0.1:11275"
+	go func() {
+		_ = netpunchlib.Server(ctx, srv, opt("server"))
+	}()
+
+	conns := [3]*net.UDPConn{}
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) //nolint:exhaustruct
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	assert.Empty(t, ask(t, conns[0], srv, "n|a|0123456789abcdef"))
+	assert.Empty(t, ask(t, conns[1], srv, "n|ab:b|fedcba9876543210")) // named session ab is not legacy pair a-b
+	assert.Equal(t, "i|a|0123456789abcdef|0|"+conns[0].LocalAddr().String(), ask(t, conns[2], srv, "n|b|0011223344556677"))
+}
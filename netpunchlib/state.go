@@ -0,0 +1,84 @@
+package netpunchlib
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const stateSaveInterval = time.Second
+
+// Registration is saved state of peer registered on control node.
+type Registration struct {
+	Session   string    `json:"session"`
+	Side      string    `json:"side"`
+	Name      string    `json:"name"`
+	Nonce     string    `json:"nonce"`
+	Addr4     string    `json:"addr4,omitempty"`
+	Addr6     string    `json:"addr6,omitempty"`
+	Local     string    `json:"local,omitempty"`
+	Predicted string    `json:"predicted,omitempty"`
+	Relay     bool      `json:"relay,omitempty"`
+	Done      bool      `json:"done,omitempty"`
+	Seen      time.Time `json:"seen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// StateStore keeps registrations of control node, so peers don't need to re-announce after restart
+// and pairings in progress are not lost. See StateStoreOption.
+type StateStore interface {
+	Load() ([]Registration, error)
+	Save(state []Registration) error
+}
+
+// FileStore is StateStore, that keeps registrations in JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates store. File is created on the first saving.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns nothing if file doesn't exist.
+func (s *FileStore) Load() ([]Registration, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := []Registration(nil)
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save replaces file atomically, so it is never left half-written.
+func (s *FileStore) Save(state []Registration) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck // it is already renamed in case of success
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}